@@ -10,10 +10,13 @@ import (
 	"path/filepath"
 	"runtime"
 	"runtime/pprof"
+	"strings"
 
 	"github.com/spf13/pflag"
 	"github.com/zyedidia/knit"
 	"github.com/zyedidia/knit/info"
+	"github.com/zyedidia/knit/lsp"
+	"github.com/zyedidia/knit/rules"
 	"github.com/zyedidia/knit/shell"
 )
 
@@ -50,9 +53,8 @@ func optBool(flags *pflag.FlagSet, name, short string, val bool, user *bool, des
 	return flags.BoolP(name, short, val, desc)
 }
 
-func parseFlags(flags *pflag.FlagSet) ([]string, error) {
+func parseFlags(flags *pflag.FlagSet, args []string) ([]string, error) {
 	var toolargs []string
-	args := os.Args[1:]
 	for i, a := range args {
 		if a == "-t" || a == "--tool" {
 			if i == len(args)-1 {
@@ -66,6 +68,65 @@ func parseFlags(flags *pflag.FlagSet) ([]string, error) {
 	return toolargs, flags.Parse(args)
 }
 
+// Returns the name of the environment variable that sets the flag 'name',
+// such as KNIT_KEEP_GOING for '--keep-going'.
+func envName(name string) string {
+	return "KNIT_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// Flags that cannot be set by environment variables.
+var noEnv = map[string]bool{
+	"help":       true,
+	"version":    true,
+	"tool":       true,
+	"cpuprofile": true,
+	"shrun":      true,
+}
+
+// Sets flags from KNIT_* environment variables. These take precedence over
+// .knit.toml files, and flags given on the command-line take precedence over
+// them.
+func setFromEnv(flags *pflag.FlagSet) error {
+	var err error
+	flags.VisitAll(func(f *pflag.Flag) {
+		v, ok := os.LookupEnv(envName(f.Name))
+		if !ok || noEnv[f.Name] || err != nil {
+			return
+		}
+		var serr error
+		if sv, ok := f.Value.(pflag.SliceValue); ok {
+			// replacing leaves the flag unchanged, so that it is replaced
+			// again rather than appended to if it is also on the
+			// command-line
+			serr = sv.Replace(strings.Split(v, ","))
+		} else {
+			serr = f.Value.Set(v)
+		}
+		if serr != nil {
+			err = fmt.Errorf("invalid value '%s' for %s: %w", v, envName(f.Name), serr)
+		}
+	})
+	return err
+}
+
+// Returns the profile selected with '--profile' in 'args' or with
+// KNIT_PROFILE, which must be known before the other flags are parsed since
+// it changes their defaults.
+func profileArg(args []string) string {
+	profile := os.Getenv(envName("profile"))
+	for i, a := range args {
+		if a == "-t" || a == "--tool" || a == "--" {
+			break
+		}
+		if a == "--profile" && i+1 < len(args) {
+			profile = args[i+1]
+		} else if strings.HasPrefix(a, "--profile=") {
+			profile = strings.TrimPrefix(a, "--profile=")
+		}
+	}
+	return profile
+}
+
 func main() {
 	wd, err := os.Getwd()
 	if err != nil {
@@ -77,11 +138,22 @@ func main() {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
+	user, err = user.WithProfile(profileArg(os.Args[1:]))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 
 	main := pflag.NewFlagSet("main", pflag.ContinueOnError)
 
 	knitfile := optString(main, "file", "f", "knitfile", user.Knitfile, "knitfile to use")
-	ncpu := optInt(main, "threads", "j", runtime.NumCPU(), user.Ncpu, "number of cores to use")
+	jobs := runtime.NumCPU()
+	if len(user.Workers) != 0 {
+		// commands run on the workers, so by default as many run at once as
+		// the workers have slots
+		jobs = rules.WorkerJobs(user.Workers)
+	}
+	ncpu := optInt(main, "threads", "j", jobs, user.Ncpu, "number of cores to use")
 	dryrun := optBool(main, "dry-run", "n", false, user.DryRun, "print commands without actually executing")
 	rundir := optString(main, "directory", "C", "", user.RunDir, "run command from directory")
 	always := optBool(main, "always-build", "B", false, user.Always, "unconditionally build all targets")
@@ -91,6 +163,9 @@ func main() {
 	hash := optBool(main, "hash", "", true, user.Hash, "hash files to determine if they are out-of-date")
 	updated := optStringSlice(main, "updated", "u", nil, user.Updated, "treat files as updated")
 	keep := optBool(main, "keep-going", "", false, user.KeepGoing, "keep going even if recipes fail")
+	ambiguity := optString(main, "ambiguity", "", "ignore", user.Ambiguity, "how to handle targets built by multiple rules (ignore, warn, error)")
+	profile := main.String("profile", "", "profile from .knit.toml to use")
+	variant := optString(main, "variant", "", "", user.Variant, "build variant to use (each variant has its own build directory and database)")
 
 	path, err := exec.LookPath("sh")
 	if err != nil {
@@ -101,6 +176,10 @@ func main() {
 		path = ex
 	}
 	shellf := optString(main, "shell", "", path, user.Shell, "shell to use when executing commands")
+	oneshell := optBool(main, "oneshell", "", false, user.OneShell, "run each recipe as a single script in one shell")
+	container := optString(main, "container", "", "", user.Container, "container runtime for rules with an image (default: podman or docker)")
+	remote := optString(main, "remote", "", "", user.Remote, "address of a remote execution server to run commands on")
+	remoteInstance := optString(main, "remote-instance", "", "", user.RemoteInstance, "instance name on the remote execution server")
 
 	debug := main.BoolP("debug", "D", false, "print debug information")
 	tool := main.StringP("tool", "t", "", "subtool to invoke (use '-t list' to list subtools); further flags are passed to the subtool")
@@ -112,7 +191,19 @@ func main() {
 	shrun := main.StringP("shrun", "c", "", "run shell command using internal shell")
 	main.MarkHidden("shrun")
 
-	toolargs, err := parseFlags(main)
+	if err := setFromEnv(main); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	// 'knit lsp' runs the language server, the same as 'knit -t lsp'
+	args := os.Args[1:]
+	lspcmd := len(args) > 0 && args[0] == "lsp"
+	if lspcmd {
+		args = args[1:]
+	}
+
+	toolargs, err := parseFlags(main, args)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
@@ -133,6 +224,7 @@ func main() {
 	if *help {
 		fmt.Println("Usage of knit:")
 		fmt.Println("  knit [TARGETS] [ARGS]")
+		fmt.Println("  knit lsp [OPTIONS]")
 		fmt.Println()
 		fmt.Println("Options:")
 		main.PrintDefaults()
@@ -160,23 +252,61 @@ func main() {
 		os.Exit(0)
 	}
 
+	flags := knit.Flags{
+		Knitfile:       *knitfile,
+		Ncpu:           *ncpu,
+		DryRun:         *dryrun,
+		RunDir:         *rundir,
+		Always:         *always,
+		Quiet:          *quiet,
+		Style:          *style,
+		CacheDir:       *cache,
+		Hash:           *hash,
+		Updated:        *updated,
+		KeepGoing:      *keep,
+		Ambiguity:      *ambiguity,
+		Variant:        *variant,
+		Profile:        *profile,
+		Shell:          *shellf,
+		OneShell:       *oneshell,
+		Container:      *container,
+		Remote:         *remote,
+		RemoteInstance: *remoteInstance,
+		Workers:        user.Workers,
+		Tool:           *tool,
+		ToolArgs:       toolargs,
+	}
+
+	// the language server is not tied to a particular Knitfile, so it is
+	// started without searching for one
+	if *tool == "lsp" || lspcmd {
+		// stdout is used for the protocol, so anything else that is printed
+		// (for example by a Knitfile) is sent to stderr
+		out := os.Stdout
+		os.Stdout = os.Stderr
+		err := lsp.Serve(os.Stdin, out, flags)
+		if err != nil {
+			fatal(err)
+		}
+		os.Exit(0)
+	}
+
 	out := os.Stdout
-	file, err := knit.Run(out, main.Args(), knit.Flags{
-		Knitfile:  *knitfile,
-		Ncpu:      *ncpu,
-		DryRun:    *dryrun,
-		RunDir:    *rundir,
-		Always:    *always,
-		Quiet:     *quiet,
-		Style:     *style,
-		CacheDir:  *cache,
-		Hash:      *hash,
-		Updated:   *updated,
-		KeepGoing: *keep,
-		Shell:     *shellf,
-		Tool:      *tool,
-		ToolArgs:  toolargs,
-	})
+	// assignments on the command-line take precedence over the ones from
+	// .knit.toml files
+	args = append(user.Assigns(), main.Args()...)
+	if user.Targets != nil {
+		targets := false
+		for _, a := range main.Args() {
+			if !strings.Contains(a, "=") {
+				targets = true
+			}
+		}
+		if !targets {
+			args = append(args, *user.Targets...)
+		}
+	}
+	file, err := knit.Run(out, args, flags)
 
 	rel, rerr := filepath.Rel(file, wd)
 	if rerr != nil {
@@ -190,7 +320,13 @@ func main() {
 		return
 	}
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "%s: %s\n", rel, err)
+		var lerr *rules.LocationError
+		if errors.As(err, &lerr) {
+			// the error already says where it comes from
+			fmt.Fprintln(os.Stderr, err)
+		} else {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", rel, err)
+		}
 		if !errors.Is(err, knit.ErrNothingToDo) {
 			os.Exit(1)
 		}
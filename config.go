@@ -2,8 +2,11 @@ package knit
 
 import (
 	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
 
 	"github.com/adrg/xdg"
 	"github.com/pelletier/go-toml/v2"
@@ -75,6 +78,71 @@ func FindBuildFile(name string) (string, string, error) {
 
 const configFile = ".knit.toml"
 
+// A Profile is a named set of flags and 'cli' assignments, defined in a
+// .knit.toml file with a '[profile.NAME]' table.
+type Profile struct {
+	UserFlags
+}
+
+// Sets the flags in 'f' that are set in 'o'. The 'cli' assignments of both
+// are combined, with the ones in 'o' taking precedence.
+func (f *UserFlags) merge(o *UserFlags) {
+	vars := make(map[string]string, len(f.Vars)+len(o.Vars))
+	for k, v := range f.Vars {
+		vars[k] = v
+	}
+	for k, v := range o.Vars {
+		vars[k] = v
+	}
+
+	fv := reflect.ValueOf(f).Elem()
+	ov := reflect.ValueOf(o).Elem()
+	for i := 0; i < fv.NumField(); i++ {
+		switch fv.Type().Field(i).Name {
+		case "Profiles", "Vars":
+			continue
+		}
+		if !ov.Field(i).IsNil() {
+			fv.Field(i).Set(ov.Field(i))
+		}
+	}
+	f.Vars = vars
+}
+
+// WithProfile returns the flags with the settings of the profile 'name'
+// applied. An empty name selects no profile.
+func (f UserFlags) WithProfile(name string) (UserFlags, error) {
+	if name == "" {
+		return f, nil
+	}
+	p, ok := f.Profiles[name]
+	if !ok {
+		return f, fmt.Errorf("unknown profile: %s", name)
+	}
+	f.merge(&p.UserFlags)
+	return f, nil
+}
+
+// Assigns returns the default 'cli' assignments as 'key=value' arguments,
+// sorted by key.
+func (f UserFlags) Assigns() []string {
+	keys := make([]string, 0, len(f.Vars))
+	for k := range f.Vars {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	assigns := make([]string, 0, len(keys))
+	for _, k := range keys {
+		assigns = append(assigns, k+"="+f.Vars[k])
+	}
+	return assigns
+}
+
+// UserDefaults loads the flags set in .knit.toml files. Files in the
+// configuration directories are loaded first, followed by the files in each
+// directory from the root down to the current directory, and settings from
+// later files replace earlier ones. Profiles with the same name in several
+// files are merged in the same way.
 func UserDefaults() (UserFlags, error) {
 	var flags UserFlags
 
@@ -85,9 +153,20 @@ func UserDefaults() (UserFlags, error) {
 			if err != nil {
 				return err
 			}
-			err = toml.Unmarshal(data, &flags)
+			var file UserFlags
+			err = toml.Unmarshal(data, &file)
 			if err != nil {
-				return err
+				return fmt.Errorf("%s: %w", configPath, err)
+			}
+			flags.merge(&file)
+			for name, p := range file.Profiles {
+				if flags.Profiles == nil {
+					flags.Profiles = make(map[string]*Profile)
+				}
+				if _, ok := flags.Profiles[name]; !ok {
+					flags.Profiles[name] = &Profile{}
+				}
+				flags.Profiles[name].merge(&p.UserFlags)
 			}
 		}
 		return nil
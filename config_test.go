@@ -0,0 +1,100 @@
+package knit
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/zyedidia/knit/rules"
+)
+
+func TestProfiles(t *testing.T) {
+	root := t.TempDir()
+	sub := filepath.Join(root, "sub")
+	if err := os.Mkdir(sub, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		root: `
+style = "steps"
+
+[vars]
+cc = "gcc"
+opt = "2"
+
+[[worker]]
+host = "build1"
+jobs = 4
+sync = true
+
+[[worker]]
+jobs = 2
+
+[profile.ci]
+keepgoing = true
+ncpu = 2
+
+[profile.ci.vars]
+cc = "clang"
+debug = "1"
+`,
+		sub: `
+[profile.ci]
+ncpu = 3
+
+[profile.ci.vars]
+debug = "0"
+`,
+	}
+	for dir, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, configFile), []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Chdir(sub)
+	defer os.Chdir(wd)
+
+	user, err := UserDefaults()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Ncpu != nil && *user.Ncpu == 3 {
+		t.Fatal("profile settings were applied without selecting the profile")
+	}
+
+	if expected := []string{"cc=gcc", "opt=2"}; !reflect.DeepEqual(user.Assigns(), expected) {
+		t.Errorf("expected vars %v, got %v", expected, user.Assigns())
+	}
+
+	workers := []rules.Worker{{Host: "build1", Jobs: 4, Sync: true}, {Jobs: 2}}
+	if !reflect.DeepEqual(user.Workers, workers) {
+		t.Errorf("expected workers %v, got %v", workers, user.Workers)
+	}
+
+	ci, err := user.WithProfile("ci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ci.Ncpu == nil || *ci.Ncpu != 3 {
+		t.Errorf("expected ncpu 3 from the closest file, got %v", ci.Ncpu)
+	}
+	if ci.KeepGoing == nil || !*ci.KeepGoing {
+		t.Errorf("expected keepgoing from the parent directory's profile")
+	}
+	if ci.Style == nil || *ci.Style != "steps" {
+		t.Errorf("expected style from outside the profile to be kept, got %v", ci.Style)
+	}
+	if expected := []string{"cc=clang", "debug=0", "opt=2"}; !reflect.DeepEqual(ci.Assigns(), expected) {
+		t.Errorf("expected vars %v, got %v", expected, ci.Assigns())
+	}
+
+	if _, err := user.WithProfile("release"); err == nil {
+		t.Error("expected an error for an unknown profile")
+	}
+}
@@ -0,0 +1,444 @@
+package knit
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/zyedidia/gopher-lua/parse"
+)
+
+// Canonical order of rule attributes. Attributes with arguments come last.
+const attrOrder = "RVMEBLOQISGTDXY"
+
+// Number of spaces that recipes are indented by, relative to their rule.
+const recipeIndent = "    "
+
+// Matches a line containing a 'name := value' assignment.
+var assignRegex = regexp.MustCompile(`^(\s*)(local\s+)?([A-Za-z_][A-Za-z0-9_.]*)\s*:=[ \t]*`)
+
+// Format rewrites the Knitfile source in 'src' in a canonical style. Rules
+// have a single space after the '$' and between targets and prereqs, their
+// attributes are sorted, and their recipes are indented by four spaces
+// relative to the rule. Assignments with ':=' have a single space around the
+// operator, and trailing whitespace is removed. Lua code is otherwise left
+// unchanged. An error is returned if the source cannot be parsed.
+func Format(src []byte, file string) ([]byte, error) {
+	if _, err := parse.Parse(bytes.NewReader(src), file); err != nil {
+		return nil, err
+	}
+
+	lines := strings.Split(strings.ReplaceAll(string(src), "\r\n", "\n"), "\n")
+	out := make([]string, 0, len(lines))
+	sc := &luaScanner{}
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		if !sc.inLong() {
+			trimmed := strings.TrimLeft(line, " \t")
+			if strings.HasPrefix(trimmed, "$") {
+				end := ruleEnd(lines, i, len(line)-len(trimmed))
+				out = append(out, formatRule(lines[i:end])...)
+				i = end - 1
+				continue
+			}
+		}
+
+		start := sc.inLong()
+		col, bare := sc.scanLine(line)
+		if col >= 0 {
+			// a rule begins in the middle of this line, so leave it and
+			// its contents as they are
+			end := ruleEnd(lines, i, col)
+			out = append(out, lines[i:end]...)
+			i = end - 1
+			continue
+		}
+		switch {
+		case bare:
+			if m := assignRegex.FindStringSubmatch(line); m != nil && !start {
+				line = m[1]
+				if m[2] != "" {
+					line += "local "
+				}
+				line += m[3] + " :="
+				if value := lines[i][len(m[0]):]; value != "" {
+					line += " " + value
+				}
+			}
+		case !sc.inLong():
+			line = strings.TrimRight(line, " \t\r")
+		}
+		out = append(out, line)
+	}
+
+	// end with exactly one newline
+	for len(out) > 0 && out[len(out)-1] == "" {
+		out = out[:len(out)-1]
+	}
+	formatted := []byte(strings.Join(out, "\n") + "\n")
+
+	if _, err := parse.Parse(bytes.NewReader(formatted), file); err != nil {
+		return nil, fmt.Errorf("formatting produced invalid code (this is a bug): %w", err)
+	}
+	return formatted, nil
+}
+
+// Returns the indentation width of 'line' (the number of leading spaces and
+// tabs), and whether the line is blank.
+func indentation(line string) (int, bool) {
+	n := len(line) - len(strings.TrimLeft(line, " \t"))
+	return n, strings.TrimSpace(line) == ""
+}
+
+// Returns the index of the line after the end of the rule that starts on
+// line 'start' with its '$' at column 'col'. The rule continues until a
+// non-blank line that is indented at most as much as the '$'.
+func ruleEnd(lines []string, start, col int) int {
+	end := start + 1
+	for ; end < len(lines); end++ {
+		n, blank := indentation(lines[end])
+		if !blank && n <= col {
+			break
+		}
+	}
+	// trailing blank lines are not part of the rule
+	for end > start+1 {
+		if _, blank := indentation(lines[end-1]); !blank {
+			break
+		}
+		end--
+	}
+	return end
+}
+
+// Formats the lines of a '$' rule.
+func formatRule(lines []string) []string {
+	first := lines[0]
+	indent := first[:len(first)-len(strings.TrimLeft(first, " \t"))]
+	header := strings.TrimSpace(strings.TrimSpace(first)[1:])
+
+	if strings.HasSuffix(header, "\\") {
+		// the rule's header continues onto the next line
+		return trimRight(lines)
+	}
+
+	out := []string{indent + "$ " + formatHeader(header)}
+
+	// strip the indentation shared by all non-blank lines of the recipe, and
+	// then indent it relative to the rule
+	recipe := lines[1:]
+	prefix := ""
+	found := false
+	for _, l := range recipe {
+		if strings.TrimSpace(l) == "" {
+			continue
+		}
+		lead := l[:len(l)-len(strings.TrimLeft(l, " \t"))]
+		if !found {
+			prefix, found = lead, true
+		}
+		for !strings.HasPrefix(lead, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	for _, l := range recipe {
+		l = strings.TrimRight(l, " \t\r")
+		if l == "" {
+			out = append(out, "")
+			continue
+		}
+		out = append(out, indent+recipeIndent+l[len(prefix):])
+	}
+	return out
+}
+
+func trimRight(lines []string) []string {
+	out := make([]string, 0, len(lines))
+	for _, l := range lines {
+		out = append(out, strings.TrimRight(l, " \t\r"))
+	}
+	return out
+}
+
+// Formats a rule header of the form 'targets:attributes: prereqs'. Headers
+// that use uncommon syntax (comments, inline recipes, or unrecognized
+// attributes) are only stripped of extra whitespace at the ends.
+func formatHeader(header string) string {
+	parts, ok := splitHeader(header)
+	if !ok || len(parts) < 2 || len(parts) > 3 {
+		return header
+	}
+	targets, prereqs := collapseSpace(parts[0]), collapseSpace(parts[len(parts)-1])
+	if len(parts) == 2 {
+		return strings.TrimRight(targets+": "+prereqs, " ")
+	}
+	attrs, ok := sortAttrs(removeSpace(parts[1]))
+	if !ok {
+		return header
+	}
+	return strings.TrimRight(targets+":"+attrs+": "+prereqs, " ")
+}
+
+// Splits a rule header at each ':' that is not quoted or part of a '$(...)'
+// expression. Returns false if the header contains syntax that should not be
+// reformatted.
+func splitHeader(header string) ([]string, bool) {
+	var parts []string
+	last := 0
+	for i := 0; i < len(header); i++ {
+		switch c := header[i]; c {
+		case '"', '\'', '`':
+			j := strings.IndexByte(header[i+1:], c)
+			if j < 0 {
+				return nil, false
+			}
+			i += j + 1
+		case '$':
+			if i+1 < len(header) && header[i+1] == '(' {
+				j := matchParen(header, i+1)
+				if j < 0 {
+					return nil, false
+				}
+				i = j
+			}
+		case '#', '>', '\\':
+			return nil, false
+		case ':':
+			parts = append(parts, header[last:i])
+			last = i + 1
+		}
+	}
+	return append(parts, header[last:]), true
+}
+
+// Returns the index of the ')' matching the '(' at 'start', or -1.
+func matchParen(s string, start int) int {
+	depth := 0
+	for i := start; i < len(s); i++ {
+		switch s[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// Removes the whitespace in the attributes 'attrs' that is not inside the
+// '[...]' argument of an attribute, since arguments (such as the interpreter
+// of 'X') may contain spaces.
+func removeSpace(attrs string) string {
+	buf := &strings.Builder{}
+	inside := false
+	for _, r := range attrs {
+		switch {
+		case r == '[':
+			inside = true
+		case r == ']':
+			inside = false
+		case unicode.IsSpace(r) && !inside:
+			continue
+		}
+		buf.WriteRune(r)
+	}
+	return buf.String()
+}
+
+// Replaces runs of whitespace outside of quotes and '$(...)' expressions with
+// single spaces, and trims the ends.
+func collapseSpace(s string) string {
+	buf := &strings.Builder{}
+	space := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == ' ' || c == '\t' {
+			space = true
+			continue
+		}
+		if space && buf.Len() > 0 {
+			buf.WriteByte(' ')
+		}
+		space = false
+		end := i
+		switch c {
+		case '"', '\'', '`':
+			end = i + 1 + strings.IndexByte(s[i+1:], c)
+		case '$':
+			if i+1 < len(s) && s[i+1] == '(' {
+				end = matchParen(s, i+1)
+			}
+		}
+		if end < i {
+			end = i
+		}
+		buf.WriteString(s[i : end+1])
+		i = end
+	}
+	return buf.String()
+}
+
+// Sorts attributes into the canonical order, keeping each attribute's '[...]'
+// argument with it. Returns false if an attribute is not recognized.
+func sortAttrs(attrs string) (string, bool) {
+	args := make(map[byte]string)
+	for i := 0; i < len(attrs); i++ {
+		c := attrs[i]
+		if strings.IndexByte(attrOrder, c) < 0 {
+			return "", false
+		}
+		arg := ""
+		if i+1 < len(attrs) && attrs[i+1] == '[' {
+			j := strings.IndexByte(attrs[i:], ']')
+			if j < 0 {
+				return "", false
+			}
+			arg = attrs[i+1 : i+j+1]
+			i += j
+		}
+		args[c] = arg
+	}
+	buf := &strings.Builder{}
+	for i := 0; i < len(attrOrder); i++ {
+		if arg, ok := args[attrOrder[i]]; ok {
+			buf.WriteByte(attrOrder[i])
+			buf.WriteString(arg)
+		}
+	}
+	return buf.String(), true
+}
+
+// A luaScanner tracks enough Lua syntax across lines to know whether a line
+// starts inside a long string or comment, which must be left unchanged.
+type luaScanner struct {
+	long  bool // inside a long string or comment
+	level int  // number of '=' in the long bracket
+}
+
+func (sc *luaScanner) inLong() bool {
+	return sc.long
+}
+
+// Returns the level of the long bracket '[=*[' at the start of 's', or -1.
+func longBracket(s string, open byte) int {
+	if len(s) == 0 || s[0] != open {
+		return -1
+	}
+	close := byte('[')
+	if open == ']' {
+		close = ']'
+	}
+	i := 1
+	for i < len(s) && s[i] == '=' {
+		i++
+	}
+	if i < len(s) && s[i] == close {
+		return i - 1
+	}
+	return -1
+}
+
+// Scans a line of Lua code. Returns the column of a '$' that starts a rule
+// in the middle of the line (or -1), and whether the line ends with a ':='
+// bare string.
+func (sc *luaScanner) scanLine(line string) (int, bool) {
+	for i := 0; i < len(line); i++ {
+		if sc.long {
+			if lvl := longBracket(line[i:], ']'); lvl == sc.level {
+				sc.long = false
+				i += lvl + 1
+			}
+			continue
+		}
+		switch c := line[i]; c {
+		case '-':
+			if strings.HasPrefix(line[i:], "--") {
+				if lvl := longBracket(line[i+2:], '['); lvl >= 0 {
+					sc.long, sc.level = true, lvl
+					i += lvl + 3
+					continue
+				}
+				return -1, false
+			}
+		case '[':
+			if lvl := longBracket(line[i:], '['); lvl >= 0 {
+				sc.long, sc.level = true, lvl
+				i += lvl + 1
+			}
+		case '"', '\'':
+			for i++; i < len(line) && line[i] != c; i++ {
+				if line[i] == '\\' {
+					i++
+				}
+			}
+		case ':':
+			if strings.HasPrefix(line[i:], ":=") {
+				return -1, true
+			}
+		case '$':
+			return i, false
+		}
+	}
+	return -1, false
+}
+
+// Formats the Knitfiles in 'args' in place, or formats the current Knitfile
+// if no files are given. With '--check', files are not modified, and the
+// names of files that are not formatted are printed instead.
+func formatFiles(w io.Writer, args []string, knitfile string) error {
+	check := false
+	files := make([]string, 0, len(args))
+	for _, a := range args {
+		switch a {
+		case "--check", "-c":
+			check = true
+		default:
+			files = append(files, a)
+		}
+	}
+	if len(files) == 0 {
+		if knitfile == "" {
+			return errors.New("no knitfile found")
+		}
+		files = append(files, knitfile)
+	}
+
+	unformatted := 0
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		formatted, err := Format(data, f)
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(data, formatted) {
+			continue
+		}
+		if check {
+			fmt.Fprintln(w, f)
+			unformatted++
+			continue
+		}
+		info, err := os.Stat(f)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(f, formatted, info.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+	if unformatted != 0 {
+		return fmt.Errorf("%d file(s) not formatted", unformatted)
+	}
+	return nil
+}
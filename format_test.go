@@ -0,0 +1,102 @@
+package knit
+
+import (
+	"testing"
+)
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		out  string
+	}{
+		{
+			name: "rule",
+			in: `return b{
+  $   foo.o  bar.o :BQV:   foo.c   bar.c   
+            gcc -c $input
+              # nested   
+}
+`,
+			out: `return b{
+  $ foo.o bar.o:VBQ: foo.c bar.c
+      gcc -c $input
+        # nested
+}
+`,
+		},
+		{
+			name: "attribute arguments",
+			in: `return b{
+$ %.o:D[%.d] Q: %.c
+	gcc -MMD -c $input -o $output
+}
+`,
+			out: `return b{
+$ %.o:QD[%.d]: %.c
+    gcc -MMD -c $input -o $output
+}
+`,
+		},
+		{
+			name: "attribute arguments with spaces",
+			in: `return b{
+$ out: X[python3  -u] Y[deps.txt] : in
+	print("hi")
+$ site:T[*.tmp *.log] V: index.md
+	make-site
+$ a.o:Y[a.dep  more.dep]: a.c
+	cc -c $input
+}
+`,
+			out: `return b{
+$ out:X[python3  -u]Y[deps.txt]: in
+    print("hi")
+$ site:VT[*.tmp *.log]: index.md
+    make-site
+$ a.o:Y[a.dep  more.dep]: a.c
+    cc -c $input
+}
+`,
+		},
+		{
+			name: "assignments",
+			in:   "cc:=gcc  \nlocal  flags   :=  -O2 -Wall\n",
+			out:  "cc := gcc  \nlocal flags := -O2 -Wall\n",
+		},
+		{
+			name: "expressions and strings",
+			in: `local s = [[
+$ not:   a rule   
+]]
+return b{
+$ all:V: $(table.concat(x,  " "))   "a  b"
+}
+
+
+`,
+			out: `local s = [[
+$ not:   a rule   
+]]
+return b{
+$ all:V: $(table.concat(x,  " ")) "a  b"
+}
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		out, err := Format([]byte(tt.in), "Knitfile")
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if string(out) != tt.out {
+			t.Errorf("%s: expected\n%s\ngot\n%s", tt.name, tt.out, string(out))
+		}
+	}
+
+	if _, err := Format([]byte("return b{"), "Knitfile"); err == nil {
+		t.Error("expected error for invalid Lua")
+	}
+}
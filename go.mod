@@ -4,6 +4,7 @@ go 1.19
 
 require (
 	github.com/adrg/xdg v0.4.0
+	github.com/bazelbuild/remote-apis v0.0.0-20230822133051-6c32c3b917cc
 	github.com/gobwas/glob v0.2.3
 	github.com/kballard/go-shellquote v0.0.0-20180428030007-95032a82bc51
 	github.com/pelletier/go-toml/v2 v2.0.5
@@ -11,18 +12,24 @@ require (
 	github.com/segmentio/fasthash v1.0.3
 	github.com/spf13/pflag v1.0.5
 	github.com/zyedidia/generic v1.2.0
+	github.com/zyedidia/gopher-lua v0.0.0-20230314215338-04b7131aa888
 	github.com/zyedidia/gopher-luar v0.0.0-20220811182431-9d2fc6a3867f
+	google.golang.org/genproto v0.0.0-20210506142907-4a47615972c2
+	google.golang.org/grpc v1.37.0
+	google.golang.org/protobuf v1.26.0
 	mvdan.cc/sh v2.6.4+incompatible
 )
 
 require (
+	github.com/golang/protobuf v1.5.2 // indirect
 	github.com/kr/pretty v0.3.1 // indirect
 	github.com/mattn/go-runewidth v0.0.13 // indirect
 	github.com/mitchellh/colorstring v0.0.0-20190213212951-d06e56a500db // indirect
 	github.com/rivo/uniseg v0.2.0 // indirect
-	github.com/zyedidia/gopher-lua v0.0.0-20230314215338-04b7131aa888 // indirect
 	golang.org/x/crypto v0.2.0 // indirect
+	golang.org/x/net v0.2.0 // indirect
 	golang.org/x/sync v0.1.0 // indirect
 	golang.org/x/sys v0.2.0 // indirect
 	golang.org/x/term v0.2.0 // indirect
+	golang.org/x/text v0.4.0 // indirect
 )
@@ -5,14 +5,17 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
 	"sync"
+	"syscall"
 	"unicode"
 	"unicode/utf8"
 
 	"github.com/adrg/xdg"
 	lua "github.com/zyedidia/gopher-lua"
+	"github.com/zyedidia/knit/remote"
 	"github.com/zyedidia/knit/rules"
 )
 
@@ -29,25 +32,54 @@ type Flags struct {
 	Hash      bool
 	Updated   []string
 	Shell     string
+	OneShell  bool
+	Container string
+	// address and instance name of a remote execution server
+	Remote         string
+	RemoteInstance string
+	// machines to run commands on with ssh (Ncpu is not changed, and
+	// rules.WorkerJobs returns the number of commands that they can run at
+	// once)
+	Workers   []rules.Worker
 	KeepGoing bool
+	Ambiguity string
+	Variant   string
+	Profile   string
 	Tool      string
 	ToolArgs  []string
+	// evaluate the Knitfile without running commands: knit.shell and
+	// knit.knit return empty strings, and configuration checks fail
+	NoCommands bool
 }
 
 // Flags that may be automatically set in a .knit.toml file.
 type UserFlags struct {
-	Knitfile  *string
-	Ncpu      *int
-	DryRun    *bool
-	RunDir    *string `toml:"directory"`
-	Always    *bool
-	Quiet     *bool
-	Style     *string
-	CacheDir  *string `toml:"cache"`
-	Hash      *bool
-	Updated   *[]string
-	Shell     *string
-	KeepGoing *bool
+	Knitfile       *string
+	Ncpu           *int
+	DryRun         *bool
+	RunDir         *string `toml:"directory"`
+	Always         *bool
+	Quiet          *bool
+	Style          *string
+	CacheDir       *string `toml:"cache"`
+	Hash           *bool
+	Updated        *[]string
+	Shell          *string
+	OneShell       *bool
+	Container      *string
+	Remote         *string
+	RemoteInstance *string
+	KeepGoing      *bool
+	Ambiguity      *string
+	Variant        *string
+	// targets to build if none are given on the command-line
+	Targets *[]string
+	// default 'cli' assignments, from the '[vars]' table
+	Vars map[string]string
+	// workers defined with '[[worker]]' tables
+	Workers []rules.Worker `toml:"worker"`
+	// profiles defined with '[profile.NAME]' tables
+	Profiles map[string]*Profile `toml:"profile"`
 }
 
 // Capitalize the first rune of a string.
@@ -104,27 +136,31 @@ func pathJoin(dir, target string) string {
 }
 
 // Changes the working directory to 'dir' and changes all targets to be
-// relative to that directory.
-func goToKnitfile(vm *LuaVM, dir string, targets []string) error {
+// relative to that directory. Returns the previous working directory relative
+// to 'dir', or the empty string if they are the same.
+func goToKnitfile(vm *LuaVM, dir string, targets []string) (string, error) {
 	wd, err := os.Getwd()
 	if err != nil {
-		return err
+		return "", err
 	}
 	adir, err := filepath.Abs(dir)
 	if err != nil {
-		return err
+		return "", err
+	}
+	r, err := rel(adir, wd)
+	if err != nil {
+		return "", err
+	}
+	if r == "." {
+		r = ""
 	}
 	for i, t := range targets {
-		r, err := rel(adir, wd)
-		if err != nil {
-			return err
-		}
-		if r != "" && r != "." {
+		if r != "" {
 			targets[i] = pathJoin(r, t)
 		}
 	}
 
-	return os.Chdir(dir)
+	return r, os.Chdir(dir)
 }
 
 var ErrNothingToDo = errors.New("nothing to be done")
@@ -182,6 +218,231 @@ func getBuildSets(lval lua.LValue) (map[string]*LBuildSet, error) {
 	return bsets, nil
 }
 
+// Evaluates the Knitfile source in 'r' (named 'file') and parses the rules in
+// all of the buildsets that it returns into a single ruleset. If 'all' is
+// true, parsing continues past rules with errors, so that all errors are
+// reported together in a rules.MultiError, along with the rules that could be
+// parsed. Otherwise the error of the first rule that cannot be parsed is
+// returned.
+func loadRules(vm *LuaVM, r io.Reader, file string, all bool) (*rules.RuleSet, error) {
+	lval, err := vm.DoReader(r, file)
+	if err != nil {
+		return nil, err
+	}
+
+	bsets, err := getBuildSets(lval)
+	if err != nil {
+		return nil, err
+	}
+
+	var rulesets []*rules.RuleSet
+	var main *rules.RuleSet
+	var errs rules.MultiError
+
+	for k, v := range bsets {
+		rs := rules.NewRuleSet(k)
+		for _, lr := range v.rset {
+			err := rules.ParseInto(lr.Contents, rs, lr.File, lr.Line, lr.Opts)
+			if err != nil && !all {
+				return nil, err
+			}
+			if merr, ok := err.(rules.MultiError); ok {
+				errs = append(errs, merr...)
+			} else if err != nil {
+				errs = append(errs, err)
+			}
+		}
+		if k == "." {
+			main = rs
+		} else {
+			rulesets = append(rulesets, rs)
+		}
+	}
+
+	if main == nil {
+		return nil, fmt.Errorf("no buildset for the root directory found")
+	}
+
+	rs := rules.MergeRuleSets(main, rulesets)
+	if len(errs) != 0 {
+		return rs, errs
+	}
+	return rs, nil
+}
+
+// Load evaluates the Knitfile source in 'r' (named 'file') from the current
+// directory, and returns the VM used for evaluation along with the rules that
+// were defined. If there were errors in some rules, the remaining rules are
+// still returned along with a rules.MultiError. Load is meant for tools that
+// inspect a Knitfile without building it.
+func Load(r io.Reader, file string, flags Flags) (*LuaVM, *rules.RuleSet, error) {
+	vm := newVM(flags, nil)
+	rs, err := loadRules(vm, r, file, true)
+	return vm, rs, err
+}
+
+// Creates a VM for evaluating a Knitfile, with the 'cli' table holding
+// 'cliAssigns' and the 'env' table holding the environment.
+func newVM(flags Flags, cliAssigns []assign) *LuaVM {
+	vm := NewLuaVM(flags.Shell, flags)
+	envAssigns, _ := makeAssigns(os.Environ())
+	vm.MakeTable("cli", cliAssigns)
+	vm.MakeTable("env", envAssigns)
+	return vm
+}
+
+// Evaluates the Knitfile 'file' with loadRules, stopping at the first rule
+// with errors.
+func loadFile(vm *LuaVM, file string) (*rules.RuleSet, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return loadRules(vm, f, file, false)
+}
+
+// Directory that build variants put their outputs in.
+const variantsDir = "build"
+
+// BuildDir returns the directory that outputs should be placed in for the
+// variant selected by 'flags', relative to the Knitfile's directory. Each
+// variant has its own directory within 'build', and builds without a variant
+// use 'build' itself.
+func BuildDir(flags Flags) string {
+	if flags.Variant == "" {
+		return variantsDir
+	}
+	return filepath.Join(variantsDir, flags.Variant)
+}
+
+// Returns an error if 'variant' cannot be used as a directory name.
+func checkVariant(variant string) error {
+	if variant == "" {
+		return nil
+	}
+	if variant == "." || variant == ".." || strings.ContainsAny(variant, `/\`) {
+		return fmt.Errorf("invalid variant name: '%s'", variant)
+	}
+	return nil
+}
+
+// Opens the database for the Knitfile 'file', which is in the current
+// directory. Each build variant has a separate database, which is stored in
+// its build directory.
+func openDatabase(file string, flags Flags) (*rules.Database, error) {
+	root := "."
+	if flags.Variant != "" {
+		root = BuildDir(flags)
+	}
+	if flags.CacheDir == "." || flags.CacheDir == "" {
+		return rules.NewDatabase(filepath.Join(root, ".knit", file)), nil
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	dir := flags.CacheDir
+	if dir == "$cache" {
+		dir = filepath.Join(xdg.CacheHome, "knit")
+	}
+	return rules.NewCacheDatabase(dir, filepath.Join(wd, root, file)), nil
+}
+
+// Creates an executor that prints commands to 'w' and other messages to
+// 'out', and runs them with 'runner' (locally if nil).
+func newExecutor(out, w io.Writer, db *rules.Database, flags Flags, runner rules.Runner, built map[string]bool) *rules.Executor {
+	lock := sync.Mutex{}
+	opts := executorOptions(flags)
+	opts.Runner = runner
+	opts.Built = built
+	return rules.NewExecutor(".", db, flags.Ncpu, NewPrinter(w, flags.Style), func(msg string) {
+		lock.Lock()
+		fmt.Fprintln(out, msg)
+		lock.Unlock()
+	}, opts)
+}
+
+// Executes 'graph' with 'ex'. Unless it is a dry run, signals such as ctrl-c
+// only stop the commands that are running (which receive them too), so that
+// the build finishes normally and its database is saved.
+func execGraph(ex *rules.Executor, graph *rules.Graph, dryrun bool) (bool, error) {
+	if !dryrun {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGHUP)
+		defer signal.Stop(sig)
+	}
+	return ex.Exec(graph)
+}
+
+// NewPrinter returns a printer that writes commands to 'w' in the given
+// style: "basic", "steps", or "progress".
+func NewPrinter(w io.Writer, style string) rules.Printer {
+	switch style {
+	case "steps":
+		return &StepPrinter{w: w}
+	case "progress":
+		return &ProgressPrinter{
+			w:     w,
+			tasks: make(map[string]string),
+		}
+	}
+	return &BasicPrinter{w: w}
+}
+
+// Returns the executor options that correspond to 'flags'.
+func executorOptions(flags Flags) rules.Options {
+	return rules.Options{
+		NoExec:       flags.DryRun,
+		Shell:        flags.Shell,
+		OneShell:     flags.OneShell,
+		AbortOnError: !flags.KeepGoing,
+		BuildAll:     flags.Always,
+		Hash:         flags.Hash,
+		Container:    flags.Container,
+	}
+}
+
+// Maximum number of times that the Knitfile is evaluated again after
+// generator rules rebuild files that it uses.
+const maxGenerations = 10
+
+// Builds the targets of the generator rules (rules with the G attribute) in
+// 'rs'. Returns true if any of them were rebuilt, in which case the Knitfile
+// must be evaluated again. The files that are built are added to 'built'.
+func generate(out, w io.Writer, vm *LuaVM, rs *rules.RuleSet, db *rules.Database, updated map[string]bool, gopts rules.GraphOptions, flags Flags, runner rules.Runner, built map[string]bool) (bool, error) {
+	gens := rs.Generators()
+	if len(gens) == 0 {
+		return false, nil
+	}
+	grs := rules.MergeRuleSets(rs, nil)
+	grs.Add(rules.NewDirectRuleBase([]string{":generate"}, gens, nil, rules.AttrSet{
+		Virtual: true,
+		NoMeta:  true,
+		Rebuild: true,
+	}))
+	graph, err := rules.NewGraph(grs, ":generate", updated, gopts)
+	if err != nil {
+		return false, err
+	}
+	err = graph.ExpandRecipes(vm)
+	if err != nil {
+		return false, err
+	}
+	rebuilt, err := execGraph(newExecutor(out, w, db, flags, runner, built), graph, flags.DryRun)
+	if serr := db.Save(); err == nil {
+		err = serr
+	}
+	return rebuilt, err
+}
+
+// Tools that are run without building a graph.
+var extraTools = []string{
+	"lsp - run a language server for Knitfiles over stdio",
+	"fmt - format Knitfiles (pass '--check' to list unformatted files instead)",
+	"options - list the options declared by the Knitfile and their values",
+}
+
 // Run searches for a Knitfile and executes it, according to args (a list of
 // targets and assignments), and the flags. All output is written to 'out'. The
 // path of the executed knitfile is returned, along with a possible error.
@@ -193,19 +454,26 @@ func Run(out io.Writer, args []string, flags Flags) (string, error) {
 		}
 	}
 
-	vm := NewLuaVM(flags.Shell, flags)
+	if err := checkVariant(flags.Variant); err != nil {
+		return "", err
+	}
 
 	cliAssigns, targets := makeAssigns(args)
-	envAssigns, _ := makeAssigns(os.Environ())
-
-	vm.MakeTable("cli", cliAssigns)
-	vm.MakeTable("env", envAssigns)
+	vm := newVM(flags, cliAssigns)
 
 	file, dir, err := FindBuildFile(flags.Knitfile)
 	if err != nil {
 		return "", err
 	}
 	knitpath := filepath.Join(dir, file)
+	if flags.Tool == "fmt" {
+		// the formatter works on the Knitfile's source, without evaluating it
+		if file == "" {
+			knitpath = ""
+		}
+		return knitpath, formatFiles(out, flags.ToolArgs, knitpath)
+	}
+	var subdir string
 	if file == "" {
 		def, ok := DefaultBuildFile()
 		if ok {
@@ -219,7 +487,7 @@ func Run(out io.Writer, args []string, flags Flags) (string, error) {
 			}
 			flags.Updated[i] = p
 		}
-		err = goToKnitfile(vm, dir, targets)
+		subdir, err = goToKnitfile(vm, dir, targets)
 		if err != nil {
 			return knitpath, err
 		}
@@ -229,39 +497,119 @@ func Run(out io.Writer, args []string, flags Flags) (string, error) {
 		return knitpath, fmt.Errorf("%s does not exist", flags.Knitfile)
 	}
 
-	lval, err := vm.DoFile(file)
+	db, err := openDatabase(file, flags)
 	if err != nil {
 		return knitpath, err
 	}
+	vm.UseDatabase(db)
 
-	bsets, err := getBuildSets(lval)
+	// Generator rules are built before anything else, except in a dry run
+	// or for tools (see below). Until they have been built, files that the
+	// Knitfile includes may not exist yet.
+	generating := flags.Tool == "" && !flags.DryRun
+	vm.allowMissing = generating
+
+	rs, err := loadFile(vm, file)
 	if err != nil {
 		return knitpath, err
 	}
 
-	var rulesets []*rules.RuleSet
-	var main *rules.RuleSet
+	if flags.Tool == "options" {
+		printOptions(out, vm.Options())
+		return knitpath, db.Save()
+	}
 
-	for k, v := range bsets {
-		rs := rules.NewRuleSet(k)
-		for _, lr := range v.rset {
-			err := rules.ParseInto(lr.Contents, rs, lr.File, lr.Line)
-			if err != nil {
-				return knitpath, err
+	updated := make(map[string]bool)
+	for _, u := range flags.Updated {
+		updated[u] = true
+	}
+
+	ambiguity, err := rules.ParseAmbiguity(flags.Ambiguity)
+	if err != nil {
+		return knitpath, err
+	}
+	warned := make(map[string]bool)
+	gopts := rules.GraphOptions{
+		Ambiguity: ambiguity,
+		Warn: func(msg string) {
+			// the graph may be created multiple times (see below)
+			if !warned[msg] {
+				fmt.Fprintln(out, msg)
+				warned[msg] = true
 			}
-		}
-		if k == "." {
-			main = rs
-		} else {
-			rulesets = append(rulesets, rs)
-		}
+		},
 	}
 
-	if main == nil {
-		return knitpath, fmt.Errorf("no buildset for the root directory found")
+	var w io.Writer = out
+	if flags.Quiet {
+		w = io.Discard
 	}
 
-	rs := rules.MergeRuleSets(main, rulesets)
+	if flags.Tool == "" && flags.Ncpu <= 0 {
+		return knitpath, errors.New("you must enable at least 1 core")
+	}
+
+	var runner rules.Runner
+	if flags.Remote != "" && len(flags.Workers) != 0 {
+		return knitpath, errors.New("remote execution and workers cannot be used together")
+	}
+	if len(flags.Workers) != 0 && flags.Tool == "" {
+		runner = rules.NewSSHRunner(flags.Workers, nil)
+	}
+	if flags.Remote != "" && flags.Tool == "" && !flags.DryRun {
+		r, err := remote.Dial(flags.Remote, flags.RemoteInstance)
+		if err != nil {
+			return knitpath, err
+		}
+		defer r.Close()
+		runner = r
+	}
+
+	// Generator rules are built before anything else, and then the Knitfile
+	// is evaluated again since it may use their outputs. Nothing is built in
+	// a dry run or for tools, so generator rules are only built as part of
+	// the main build in those cases.
+	generated := false
+	built := make(map[string]bool)
+	for i := 0; generating; i++ {
+		// -B is not used for generator rules, since they would never be
+		// up-to-date, and they are rebuilt by the main build instead, unless
+		// they were just built here. Files given with --updated only cause
+		// them to be rebuilt once.
+		gflags := flags
+		gflags.Always = false
+		gupdated := updated
+		if i != 0 {
+			gupdated = nil
+		}
+		regen, err := generate(out, w, vm, rs, db, gupdated, gopts, gflags, runner, built)
+		if err != nil {
+			return knitpath, err
+		}
+		if !regen && len(vm.missing) != 0 {
+			// the missing files were not built by generator rules, so
+			// evaluate the Knitfile again to report the error
+			vm = newVM(flags, cliAssigns)
+			vm.UseDatabase(db)
+			if rs, err = loadFile(vm, file); err != nil {
+				return knitpath, err
+			}
+		}
+		if !regen {
+			break
+		}
+		generated = true
+		if i == maxGenerations {
+			return knitpath, fmt.Errorf("generator rules were still out-of-date after evaluating the Knitfile %d times", maxGenerations+1)
+		}
+		vm = newVM(flags, cliAssigns)
+		vm.UseDatabase(db)
+		vm.allowMissing = true
+		rs, err = loadFile(vm, file)
+		if err != nil {
+			return knitpath, err
+		}
+	}
 
 	alltargets := rs.AllTargets()
 
@@ -298,15 +646,16 @@ func Run(out io.Writer, args []string, flags Flags) (string, error) {
 		Rebuild: true,
 	}))
 
-	updated := make(map[string]bool)
-	for _, u := range flags.Updated {
-		updated[u] = true
-	}
-
-	graph, err := rules.NewGraph(rs, ":build", updated)
+	graph, err := rules.NewGraph(rs, ":build", updated, gopts)
 	if err != nil {
-		g, rerr := rules.NewGraph(rs, ":build-root", updated)
+		g, rerr := rules.NewGraph(rs, ":build-root", updated, gopts)
 		if rerr != nil {
+			var nerr *rules.NoRuleError
+			if subdir != "" && errors.As(err, &nerr) && nerr.Rule == "" {
+				// the target was given relative to the working directory,
+				// so suggest targets relative to it as well
+				nerr.RelativeTo(subdir)
+			}
 			return knitpath, err
 		}
 		graph = g
@@ -317,31 +666,11 @@ func Run(out io.Writer, args []string, flags Flags) (string, error) {
 		return knitpath, err
 	}
 
-	var db *rules.Database
-	if flags.CacheDir == "." || flags.CacheDir == "" {
-		db = rules.NewDatabase(filepath.Join(".knit", file))
-	} else {
-		wd, err := os.Getwd()
-		if err != nil {
-			return knitpath, err
-		}
-		dir := flags.CacheDir
-		if dir == "$cache" {
-			dir = filepath.Join(xdg.CacheHome, "knit")
-		}
-		db = rules.NewCacheDatabase(dir, filepath.Join(wd, file))
-	}
-
-	var w io.Writer = out
-	if flags.Quiet {
-		w = io.Discard
-	}
-
 	if flags.Tool != "" {
 		var t rules.Tool
 		switch flags.Tool {
 		case "list":
-			t = &rules.ListTool{W: w}
+			t = &rules.ListTool{W: w, Extra: extraTools}
 		case "graph":
 			t = &rules.GraphTool{W: w}
 		case "clean":
@@ -358,6 +687,8 @@ func Run(out io.Writer, args []string, flags Flags) (string, error) {
 			t = &rules.PathTool{W: w, Path: knitpath}
 		case "db":
 			t = &rules.DbTool{W: w, Db: db}
+		case "lint":
+			t = &rules.LintTool{W: w}
 		default:
 			return knitpath, fmt.Errorf("unknown tool: %s", flags.Tool)
 		}
@@ -370,37 +701,8 @@ func Run(out io.Writer, args []string, flags Flags) (string, error) {
 		return knitpath, db.Save()
 	}
 
-	if flags.Ncpu <= 0 {
-		return knitpath, errors.New("you must enable at least 1 core")
-	}
-
-	var printer rules.Printer
-	switch flags.Style {
-	case "steps":
-		printer = &StepPrinter{w: w}
-	case "progress":
-		printer = &ProgressPrinter{
-			w:     w,
-			tasks: make(map[string]string),
-		}
-	default:
-		printer = &BasicPrinter{w: w}
-	}
-
-	lock := sync.Mutex{}
-	ex := rules.NewExecutor(".", db, flags.Ncpu, printer, func(msg string) {
-		lock.Lock()
-		fmt.Fprintln(out, msg)
-		lock.Unlock()
-	}, rules.Options{
-		NoExec:       flags.DryRun,
-		Shell:        flags.Shell,
-		AbortOnError: !flags.KeepGoing,
-		BuildAll:     flags.Always,
-		Hash:         flags.Hash,
-	})
-
-	rebuilt, execerr := ex.Exec(graph)
+	ex := newExecutor(out, w, db, flags, runner, built)
+	rebuilt, execerr := execGraph(ex, graph, flags.DryRun)
 
 	err = db.Save()
 	if err != nil {
@@ -409,7 +711,7 @@ func Run(out io.Writer, args []string, flags Flags) (string, error) {
 	if execerr != nil {
 		return knitpath, execerr
 	}
-	if !rebuilt {
+	if !rebuilt && !generated {
 		return knitpath, fmt.Errorf("'%s': %w", strings.Join(targets, " "), ErrNothingToDo)
 	}
 	return knitpath, nil
@@ -23,6 +23,7 @@ type Test struct {
 
 type Build struct {
 	Args     []string
+	Tool     string // overrides the tool in the test's flags
 	Output   string
 	Notbuilt []string
 	Error    string
@@ -63,11 +64,12 @@ func runTest(dir string, t *testing.T) {
 	defer os.Chdir(wd)
 	for i, b := range test.Builds {
 		buf := &bytes.Buffer{}
-		_, err := knit.Run(buf, b.Args, test.Flags)
-		if err != nil {
-			if err.Error() == b.Error {
-				continue
-			}
+		flags := test.Flags
+		if b.Tool != "" {
+			flags.Tool = b.Tool
+		}
+		_, err := knit.Run(buf, b.Args, flags)
+		if err != nil && err.Error() != b.Error {
 			t.Fatalf("%d: %v", i, err)
 		}
 
@@ -85,6 +87,13 @@ func runTest(dir string, t *testing.T) {
 		}
 	}
 	os.RemoveAll(".knit")
+	if v := test.Flags.Variant; v != "" {
+		// the variant's database is in its build directory, which is
+		// removed too if nothing else is left in it
+		os.RemoveAll(filepath.Join("build", v, ".knit"))
+		os.Remove(filepath.Join("build", v))
+		os.Remove("build")
+	}
 }
 
 func TestAll(t *testing.T) {
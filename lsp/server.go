@@ -0,0 +1,576 @@
+// Package lsp implements a language server for Knitfiles. It provides
+// diagnostics for errors in the Lua program and in rules, go-to-definition
+// from a target or prereq to the rules that build it, hover information with
+// a target's expanded recipe, completion of target names, and formatting.
+package lsp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/zyedidia/knit"
+	"github.com/zyedidia/knit/info"
+	"github.com/zyedidia/knit/rules"
+)
+
+// A Server answers requests from a language client for a set of open
+// Knitfiles.
+type Server struct {
+	conn  *conn
+	flags knit.Flags
+	docs  map[string]*document
+	// documents that have changed since they were last evaluated
+	pending map[string]bool
+}
+
+// Time to wait after a document changes before evaluating it, so that it is
+// evaluated once the user stops typing rather than after every keystroke.
+const debounce = 300 * time.Millisecond
+
+type document struct {
+	path  string
+	text  string
+	lines []string
+
+	// results of evaluating the document
+	vm    *knit.LuaVM
+	rs    *rules.RuleSet
+	diags []diagnostic
+}
+
+// Serve runs a language server that reads requests from 'r' and writes
+// responses to 'w', until the client asks the server to exit. Knitfiles are
+// evaluated with 'flags', without running any commands, since the editor may
+// open a Knitfile that should not be trusted, and a command may be only
+// partially written.
+func Serve(r io.Reader, w io.Writer, flags knit.Flags) error {
+	flags.NoCommands = true
+	s := &Server{
+		conn:    newConn(r, w),
+		flags:   flags,
+		docs:    make(map[string]*document),
+		pending: make(map[string]bool),
+	}
+
+	// messages are read in the background so that pending documents can be
+	// evaluated while waiting for the next one
+	msgs := make(chan *message)
+	errs := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			msg, err := s.conn.read()
+			if err != nil {
+				errs <- err
+				return
+			}
+			select {
+			case msgs <- msg:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var timer *time.Timer
+	var timeout <-chan time.Time
+	for {
+		var msg *message
+		select {
+		case <-timeout:
+			timeout = nil
+			s.flush()
+			continue
+		case err := <-errs:
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		case msg = <-msgs:
+		}
+
+		if msg.Method == "exit" {
+			return nil
+		}
+		result, rerr := s.handle(msg)
+		if len(s.pending) > 0 && (timeout == nil || msg.Method == "textDocument/didChange") {
+			// wait until there have been no changes for a while
+			if timer != nil {
+				timer.Stop()
+			}
+			timer = time.NewTimer(debounce)
+			timeout = timer.C
+		}
+		if msg.ID == nil {
+			// notifications have no response
+			continue
+		}
+		resp := &message{ID: msg.ID, Error: rerr, Result: result}
+		if rerr == nil && result == nil {
+			resp.Result = json.RawMessage("null")
+		}
+		if err := s.conn.write(resp); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Server) handle(msg *message) (interface{}, *responseError) {
+	switch msg.Method {
+	case "initialize":
+		return map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				"textDocumentSync":           1, // full document sync
+				"definitionProvider":         true,
+				"hoverProvider":              true,
+				"completionProvider":         map[string]interface{}{},
+				"documentFormattingProvider": true,
+			},
+			"serverInfo": map[string]string{
+				"name":    "knit",
+				"version": info.Version,
+			},
+		}, nil
+	case "initialized", "shutdown", "$/cancelRequest":
+		return nil, nil
+	case "textDocument/didOpen":
+		var params didOpenParams
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, invalidParams(err)
+		}
+		s.evaluate(params.TextDocument.URI, params.TextDocument.Text)
+	case "textDocument/didChange":
+		var params didChangeParams
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, invalidParams(err)
+		}
+		if n := len(params.ContentChanges); n > 0 {
+			s.change(params.TextDocument.URI, params.ContentChanges[n-1].Text)
+		}
+	case "textDocument/didSave":
+		var params didSaveParams
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, invalidParams(err)
+		}
+		// re-evaluate, since files that the Knitfile depends on may have
+		// changed as well
+		if doc, ok := s.docs[params.TextDocument.URI]; ok {
+			text := doc.text
+			if params.Text != nil {
+				text = *params.Text
+			}
+			s.evaluate(params.TextDocument.URI, text)
+		}
+	case "textDocument/didClose":
+		var params didCloseParams
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, invalidParams(err)
+		}
+		delete(s.docs, params.TextDocument.URI)
+		delete(s.pending, params.TextDocument.URI)
+		s.publish(params.TextDocument.URI, nil)
+	case "textDocument/definition":
+		var params positionParams
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, invalidParams(err)
+		}
+		return s.definition(params), nil
+	case "textDocument/hover":
+		var params positionParams
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, invalidParams(err)
+		}
+		if h := s.hover(params); h != nil {
+			return h, nil
+		}
+	case "textDocument/completion":
+		var params positionParams
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, invalidParams(err)
+		}
+		return s.completion(params), nil
+	case "textDocument/formatting":
+		var params documentParams
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, invalidParams(err)
+		}
+		return s.format(params.TextDocument.URI), nil
+	default:
+		if msg.ID != nil {
+			return nil, &responseError{
+				Code:    codeMethodNotFound,
+				Message: fmt.Sprintf("method not supported: %s", msg.Method),
+			}
+		}
+	}
+	return nil, nil
+}
+
+func invalidParams(err error) *responseError {
+	return &responseError{
+		Code:    codeInvalidParams,
+		Message: err.Error(),
+	}
+}
+
+func uriToPath(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return uri
+	}
+	return filepath.FromSlash(u.Path)
+}
+
+func pathToURI(path string) string {
+	u := url.URL{Scheme: "file", Path: filepath.ToSlash(path)}
+	return u.String()
+}
+
+// Runs 'fn' from the directory containing the document, which is where the
+// Knitfile is evaluated.
+func (d *document) inDir(fn func()) {
+	wd, err := os.Getwd()
+	if err == nil {
+		if os.Chdir(filepath.Dir(d.path)) == nil {
+			defer os.Chdir(wd)
+		}
+	}
+	fn()
+}
+
+// Stores the new text of a document that is being edited. It is evaluated
+// once it stops changing (or when a request needs the result).
+func (s *Server) change(uri, text string) {
+	s.docs[uri] = &document{
+		path:  uriToPath(uri),
+		text:  text,
+		lines: strings.Split(text, "\n"),
+	}
+	s.pending[uri] = true
+}
+
+// Evaluates the document 'uri' if it has changed since it was last
+// evaluated.
+func (s *Server) flushDoc(uri string) {
+	if !s.pending[uri] {
+		return
+	}
+	s.evaluate(uri, s.docs[uri].text)
+}
+
+// Evaluates all documents that have changed.
+func (s *Server) flush() {
+	for uri := range s.pending {
+		s.flushDoc(uri)
+	}
+}
+
+// Stores the new text of a document, evaluates it, and publishes the
+// resulting diagnostics.
+func (s *Server) evaluate(uri, text string) {
+	delete(s.pending, uri)
+	doc := &document{
+		path:  uriToPath(uri),
+		text:  text,
+		lines: strings.Split(text, "\n"),
+	}
+	s.docs[uri] = doc
+	doc.inDir(func() {
+		doc.analyze(s.flags)
+	})
+	s.publish(uri, doc.diags)
+}
+
+func (s *Server) publish(uri string, diags []diagnostic) {
+	if diags == nil {
+		diags = []diagnostic{}
+	}
+	s.conn.write(&message{
+		Method: "textDocument/publishDiagnostics",
+		Params: mustMarshal(publishDiagnosticsParams{
+			URI:         uri,
+			Diagnostics: diags,
+		}),
+	})
+}
+
+func mustMarshal(v interface{}) json.RawMessage {
+	data, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+// Matches errors of the form 'file:line: message' (from rules and the Lua
+// runtime) and 'file line:N(column:M) message' (from the Lua compiler).
+var errRegex = regexp.MustCompile(`^(.+?)(?::(\d+):| line:(\d+)\(column:\d+\))\s*(.*)$`)
+
+// Evaluates the document and records the rules it defines along with any
+// diagnostics.
+func (d *document) analyze(flags knit.Flags) {
+	name := filepath.Base(d.path)
+	vm, rs, err := knit.Load(strings.NewReader(d.text), name, flags)
+	d.vm = vm
+	d.rs = rs
+
+	var merr rules.MultiError
+	var emsg *knit.ErrMessage
+	switch {
+	case errors.As(err, &merr):
+		for _, e := range merr {
+			d.diags = append(d.diags, d.errDiagnostic(name, e.Error()))
+		}
+	case errors.Is(err, knit.ErrQuiet), errors.As(err, &emsg):
+		// the Knitfile chose not to return any rules
+	case err != nil:
+		d.diags = append(d.diags, d.errDiagnostic(name, err.Error()))
+	}
+
+	if rs == nil {
+		return
+	}
+
+	// report prereqs that cannot be built
+	resolved := make(map[string]error)
+	for _, r := range rs.Rules() {
+		if r.Meta || r.File != name {
+			continue
+		}
+		for _, p := range r.Prereqs {
+			target := p
+			if r.Dir != "." && !filepath.IsAbs(p) {
+				target = filepath.Join(r.Dir, p)
+			}
+			err, ok := resolved[target]
+			if !ok {
+				_, err = rules.NewGraph(rs, target, nil, rules.GraphOptions{})
+				resolved[target] = err
+			}
+			if err != nil {
+				d.diags = append(d.diags, diagnostic{
+					Range:    d.lineRange(r.Line - 1),
+					Severity: severityWarning,
+					Source:   "knit",
+					Message:  fmt.Sprintf("prereq '%s' cannot be built: %v", p, err),
+				})
+			}
+		}
+	}
+}
+
+// Converts an error message into a diagnostic. Errors that do not refer to a
+// line in this document are shown at its first line.
+func (d *document) errDiagnostic(name, msg string) diagnostic {
+	msg, _, _ = strings.Cut(msg, "\n")
+	line := 0
+	if m := errRegex.FindStringSubmatch(msg); m != nil && m[1] == name {
+		num := m[2]
+		if num == "" {
+			num = m[3]
+		}
+		fmt.Sscanf(num, "%d", &line)
+		line--
+		msg = m[4]
+	}
+	return diagnostic{
+		Range:    d.lineRange(line),
+		Severity: severityError,
+		Source:   "knit",
+		Message:  msg,
+	}
+}
+
+// Returns the range covering the given (zero-indexed) line.
+func (d *document) lineRange(line int) lspRange {
+	if line < 0 || line >= len(d.lines) {
+		line = 0
+	}
+	end := 0
+	if line < len(d.lines) {
+		end = len(utf16.Encode([]rune(strings.TrimRight(d.lines[line], "\r"))))
+	}
+	return lspRange{
+		Start: position{Line: line},
+		End:   position{Line: line, Character: end},
+	}
+}
+
+func isWordDelim(r rune) bool {
+	return strings.ContainsRune(" \t\r:[](){}\"'`,", r)
+}
+
+// Returns the target or prereq name at 'pos'.
+func (d *document) wordAt(pos position) string {
+	if pos.Line < 0 || pos.Line >= len(d.lines) {
+		return ""
+	}
+	line := d.lines[pos.Line]
+	// convert the UTF-16 offset into a byte offset
+	off, units := 0, 0
+	for off < len(line) && units < pos.Character {
+		r, size := utf8.DecodeRuneInString(line[off:])
+		off += size
+		units += len(utf16.Encode([]rune{r}))
+	}
+	start, end := off, off
+	for start > 0 {
+		r, size := utf8.DecodeLastRuneInString(line[:start])
+		if isWordDelim(r) {
+			break
+		}
+		start -= size
+	}
+	for end < len(line) {
+		r, size := utf8.DecodeRuneInString(line[end:])
+		if isWordDelim(r) {
+			break
+		}
+		end += size
+	}
+	return line[start:end]
+}
+
+// Returns the document and the rules that build the name at the requested
+// position.
+func (s *Server) lookup(params positionParams) (*document, string, []rules.RuleInfo) {
+	s.flushDoc(params.TextDocument.URI)
+	doc, ok := s.docs[params.TextDocument.URI]
+	if !ok || doc.rs == nil {
+		return nil, "", nil
+	}
+	word := doc.wordAt(params.Position)
+	if word == "" {
+		return nil, "", nil
+	}
+	var defs []rules.RuleInfo
+	doc.inDir(func() {
+		defs = doc.rs.Definitions(word)
+	})
+	return doc, word, defs
+}
+
+func (s *Server) definition(params positionParams) []location {
+	doc, _, defs := s.lookup(params)
+	locs := make([]location, 0, len(defs))
+	for _, def := range defs {
+		if def.File == "" || def.Line <= 0 {
+			continue
+		}
+		path := def.File
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(filepath.Dir(doc.path), path)
+		}
+		pos := position{Line: def.Line - 1}
+		locs = append(locs, location{
+			URI:   pathToURI(path),
+			Range: lspRange{Start: pos, End: pos},
+		})
+	}
+	return locs
+}
+
+func (s *Server) hover(params positionParams) *hover {
+	doc, word, defs := s.lookup(params)
+	if len(defs) == 0 {
+		return nil
+	}
+
+	// use the expanded recipe if the target can be fully resolved, and
+	// otherwise the recipe of the last rule that has one
+	var recipe []string
+	doc.inDir(func() {
+		g, err := rules.NewGraph(doc.rs, word, nil, rules.GraphOptions{})
+		if err == nil && g.ExpandRecipes(doc.vm) == nil {
+			recipe = g.Recipe()
+		}
+	})
+	if recipe == nil {
+		for _, def := range defs {
+			if len(def.Recipe) != 0 {
+				recipe = def.Recipe
+			}
+		}
+	}
+
+	buf := &strings.Builder{}
+	for _, def := range defs {
+		fmt.Fprintf(buf, "`%s: %s` (%s:%d)\n\n", strings.Join(def.Targets, " "), strings.Join(def.Prereqs, " "), def.File, def.Line)
+	}
+	if len(recipe) != 0 {
+		fmt.Fprintf(buf, "```sh\n%s\n```\n", strings.Join(recipe, "\n"))
+	}
+	return &hover{
+		Contents: markupContent{
+			Kind:  "markdown",
+			Value: buf.String(),
+		},
+	}
+}
+
+func (s *Server) completion(params positionParams) []completionItem {
+	s.flushDoc(params.TextDocument.URI)
+	doc, ok := s.docs[params.TextDocument.URI]
+	if !ok || doc.rs == nil {
+		return []completionItem{}
+	}
+	items := make(map[string]completionItem)
+	for _, r := range doc.rs.Rules() {
+		if r.Meta {
+			continue
+		}
+		kind := completionKindFile
+		if r.Attrs.Virtual {
+			kind = completionKindKeyword
+		}
+		for _, t := range r.Targets {
+			if r.Dir != "." {
+				t = filepath.Join(r.Dir, t)
+			}
+			items[t] = completionItem{
+				Label:  t,
+				Kind:   kind,
+				Detail: fmt.Sprintf("%s:%d", r.File, r.Line),
+			}
+		}
+	}
+	list := make([]completionItem, 0, len(items))
+	for _, item := range items {
+		list = append(list, item)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Label < list[j].Label
+	})
+	return list
+}
+
+// Returns an edit that replaces the document with its formatted text, or no
+// edits if the document cannot be formatted.
+func (s *Server) format(uri string) []textEdit {
+	doc, ok := s.docs[uri]
+	if !ok {
+		return []textEdit{}
+	}
+	formatted, err := knit.Format([]byte(doc.text), filepath.Base(doc.path))
+	if err != nil || string(formatted) == doc.text {
+		return []textEdit{}
+	}
+	return []textEdit{{
+		Range: lspRange{
+			End: position{Line: len(doc.lines)},
+		},
+		NewText: string(formatted),
+	}}
+}
@@ -0,0 +1,165 @@
+package lsp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/zyedidia/knit"
+)
+
+const knitfile = `return b{
+$ all:V: foo.txt
+$ foo.txt: missing.c
+    echo foo > $output
+$ bar.txt:Z:
+    echo bar > $output
+}
+`
+
+// A session is a sequence of messages from a client.
+type session struct {
+	in bytes.Buffer
+}
+
+func (s *session) send(id int, method string, params interface{}) {
+	msg := map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params}
+	if id != 0 {
+		msg["id"] = id
+	}
+	data, _ := json.Marshal(msg)
+	fmt.Fprintf(&s.in, "Content-Length: %d\r\n\r\n%s", len(data), data)
+}
+
+// Runs a server on the messages of the session, and returns the results of
+// the requests by ID and the parameters of the last notification of each
+// method.
+func (s *session) run(t *testing.T) map[string]json.RawMessage {
+	s.send(0, "exit", nil)
+	wd, _ := os.Getwd()
+	out := &bytes.Buffer{}
+	if err := Serve(&s.in, out, knit.Flags{Shell: "sh"}); err != nil {
+		t.Fatal(err)
+	}
+	if cwd, _ := os.Getwd(); cwd != wd {
+		t.Errorf("working directory changed to %s", cwd)
+	}
+
+	c := newConn(out, nil)
+	msgs := make(map[string]json.RawMessage)
+	for {
+		msg, err := c.read()
+		if err != nil {
+			break
+		}
+		if msg.ID != nil {
+			result, _ := json.Marshal(msg.Result)
+			msgs[string(*msg.ID)] = result
+		} else {
+			msgs[msg.Method] = msg.Params
+		}
+	}
+	return msgs
+}
+
+func TestServer(t *testing.T) {
+	dir := t.TempDir()
+	uri := pathToURI(filepath.Join(dir, "Knitfile"))
+
+	s := &session{}
+	doc := map[string]string{"uri": uri}
+	s.send(1, "initialize", map[string]interface{}{})
+	s.send(0, "textDocument/didOpen", map[string]interface{}{
+		"textDocument": map[string]string{"uri": uri, "text": knitfile},
+	})
+	s.send(2, "textDocument/definition", map[string]interface{}{
+		"textDocument": doc,
+		"position":     map[string]int{"line": 1, "character": 10},
+	})
+	s.send(3, "textDocument/completion", map[string]interface{}{
+		"textDocument": doc,
+		"position":     map[string]int{"line": 0, "character": 0},
+	})
+	msgs := s.run(t)
+
+	var diags publishDiagnosticsParams
+	json.Unmarshal(msgs["textDocument/publishDiagnostics"], &diags)
+	expect := map[int]string{
+		1: "prereq 'foo.txt' cannot be built",
+		2: "prereq 'missing.c' cannot be built",
+		4: "unrecognized attribute: Z",
+	}
+	if len(diags.Diagnostics) != len(expect) {
+		t.Fatalf("expected %d diagnostics, got %v", len(expect), diags.Diagnostics)
+	}
+	for _, d := range diags.Diagnostics {
+		if !strings.Contains(d.Message, expect[d.Range.Start.Line]) {
+			t.Errorf("line %d: unexpected diagnostic %q", d.Range.Start.Line, d.Message)
+		}
+	}
+
+	var locs []location
+	json.Unmarshal(msgs["2"], &locs)
+	if len(locs) != 1 || locs[0].URI != uri || locs[0].Range.Start.Line != 2 {
+		t.Errorf("unexpected definition: %v", locs)
+	}
+
+	var items []completionItem
+	json.Unmarshal(msgs["3"], &items)
+	labels := make([]string, 0, len(items))
+	for _, item := range items {
+		labels = append(labels, item.Label)
+	}
+	if strings.Join(labels, " ") != "all bar.txt foo.txt" {
+		t.Errorf("unexpected completions: %v", labels)
+	}
+}
+
+func TestChange(t *testing.T) {
+	dir := t.TempDir()
+	uri := pathToURI(filepath.Join(dir, "Knitfile"))
+	ran := filepath.Join(dir, "ran")
+
+	s := &session{}
+	doc := map[string]string{"uri": uri}
+	s.send(0, "textDocument/didOpen", map[string]interface{}{
+		"textDocument": map[string]string{"uri": uri, "text": "return b{}\n"},
+	})
+	s.send(0, "textDocument/didChange", map[string]interface{}{
+		"textDocument":   doc,
+		"contentChanges": []map[string]string{{"text": "local x = require('knit').shell('touch ran')\nreturn b{\n$ foo.txt:\n}\n"}},
+	})
+	// the changed document is evaluated before the request is answered
+	s.send(1, "textDocument/completion", map[string]interface{}{
+		"textDocument": doc,
+		"position":     map[string]int{"line": 0, "character": 0},
+	})
+	msgs := s.run(t)
+
+	var items []completionItem
+	json.Unmarshal(msgs["1"], &items)
+	if len(items) != 1 || items[0].Label != "foo.txt" {
+		t.Errorf("unexpected completions: %v", items)
+	}
+	if _, err := os.Stat(ran); err == nil {
+		t.Errorf("command was run while the document was being edited")
+	}
+
+	// commands are not run when the document is opened or saved either
+	s = &session{}
+	s.send(0, "textDocument/didOpen", map[string]interface{}{
+		"textDocument": map[string]string{"uri": uri, "text": "local x = require('knit').shell('touch ran')\nreturn b{}\n"},
+	})
+	s.send(0, "textDocument/didSave", map[string]interface{}{
+		"textDocument": doc,
+		"text":         "local x = require('knit').shell('touch ran')\nreturn b{}\n",
+	})
+	s.run(t)
+	if _, err := os.Stat(ran); err == nil {
+		t.Errorf("command was run when the document was opened or saved")
+	}
+}
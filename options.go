@@ -0,0 +1,202 @@
+package knit
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	lua "github.com/zyedidia/gopher-lua"
+)
+
+// An Option is a setting declared by the Knitfile with 'knit.option'. Its value
+// comes from the 'cli' table, then the 'env' table, and otherwise from its
+// default.
+type Option struct {
+	Name    string
+	Type    string // one of "string", "bool", "number", or "list"
+	Help    string
+	Choices []string
+	Default lua.LValue
+	Value   lua.LValue
+	// where the value came from: "cli", "env", or "default"
+	Source string
+}
+
+var optionTypes = []string{"string", "bool", "number", "list"}
+
+// Converts the string 's' given for the option 'o' to a Lua value of the
+// option's type.
+func (o *Option) parse(L *lua.LState, s string) (lua.LValue, error) {
+	switch o.Type {
+	case "bool":
+		switch strings.ToLower(s) {
+		case "true", "yes", "on", "1":
+			return lua.LTrue, nil
+		case "false", "no", "off", "0", "":
+			return lua.LFalse, nil
+		}
+		return nil, fmt.Errorf("invalid value '%s' (expected true or false)", s)
+	case "number":
+		n, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value '%s' (expected a number)", s)
+		}
+		return lua.LNumber(n), nil
+	case "list":
+		return GoStrSliceToTable(L, strings.Fields(s)), nil
+	}
+	if len(o.Choices) != 0 && !contains(o.Choices, s) {
+		return nil, fmt.Errorf("invalid value '%s' (expected one of %s)", s, strings.Join(o.Choices, ", "))
+	}
+	return lua.LString(s), nil
+}
+
+// Checks that the default value 'v' has the option's type.
+func (o *Option) check(v lua.LValue) error {
+	if v == lua.LNil {
+		return nil
+	}
+	want := map[string]lua.LValueType{
+		"string": lua.LTString,
+		"bool":   lua.LTBool,
+		"number": lua.LTNumber,
+		"list":   lua.LTTable,
+	}[o.Type]
+	if v.Type() != want {
+		return fmt.Errorf("default value %s is not a %s", LToString(v), o.Type)
+	}
+	if len(o.Choices) != 0 && !contains(o.Choices, LToString(v)) {
+		return fmt.Errorf("default value '%s' is not one of %s", LToString(v), strings.Join(o.Choices, ", "))
+	}
+	return nil
+}
+
+func contains(strs []string, s string) bool {
+	for _, x := range strs {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Implements 'knit.option(name, spec)', which declares an option and returns
+// its value. The spec is a table that may have the fields 'type', 'default',
+// 'help', and 'choices'. Declaring an option again returns the same value.
+func (vm *LuaVM) declareOption(L *lua.LState) int {
+	name := L.CheckString(1)
+	spec := L.OptTable(2, L.NewTable())
+
+	if o, ok := vm.optindex[name]; ok {
+		L.Push(o.Value)
+		return 1
+	}
+
+	o := &Option{
+		Name:    name,
+		Default: spec.RawGetString("default"),
+		Source:  "default",
+	}
+	switch help := spec.RawGetString("help").(type) {
+	case *lua.LNilType:
+	case lua.LString:
+		o.Help = string(help)
+	default:
+		L.RaiseError("option '%s': help must be a string", name)
+	}
+	switch choices := spec.RawGetString("choices").(type) {
+	case *lua.LNilType:
+	case *lua.LTable:
+		choices.ForEach(func(_, v lua.LValue) {
+			o.Choices = append(o.Choices, LToString(v))
+		})
+	default:
+		L.RaiseError("option '%s': choices must be a table", name)
+	}
+	switch typ := spec.RawGetString("type").(type) {
+	case *lua.LNilType:
+		// infer the type from the default
+		switch o.Default.Type() {
+		case lua.LTBool:
+			o.Type = "bool"
+		case lua.LTNumber:
+			o.Type = "number"
+		case lua.LTTable:
+			o.Type = "list"
+		default:
+			o.Type = "string"
+		}
+	case lua.LString:
+		if !contains(optionTypes, string(typ)) {
+			L.RaiseError("option '%s': unknown type '%s' (expected one of %s)", name, typ, strings.Join(optionTypes, ", "))
+		}
+		o.Type = string(typ)
+	default:
+		L.RaiseError("option '%s': type must be a string", name)
+	}
+	if o.Type == "bool" && o.Default == lua.LNil {
+		o.Default = lua.LFalse
+	}
+	if err := o.check(o.Default); err != nil {
+		L.RaiseError("option '%s': %v", name, err)
+	}
+
+	o.Value = o.Default
+	for _, src := range []string{"cli", "env"} {
+		tbl, ok := L.GetGlobal(src).(*lua.LTable)
+		if !ok {
+			continue
+		}
+		s, ok := tbl.RawGetString(name).(lua.LString)
+		if !ok {
+			continue
+		}
+		v, err := o.parse(L, string(s))
+		if err != nil {
+			L.RaiseError("option '%s' (from %s): %v", name, src, err)
+		}
+		o.Value = v
+		o.Source = src
+		break
+	}
+
+	vm.options = append(vm.options, o)
+	vm.optindex[name] = o
+	L.Push(o.Value)
+	return 1
+}
+
+// Options returns the options that were declared by the Knitfile, in the
+// order they were declared.
+func (vm *LuaVM) Options() []*Option {
+	return vm.options
+}
+
+// Writes a description of each option in 'opts' to 'w'.
+func printOptions(w io.Writer, opts []*Option) {
+	for _, o := range opts {
+		desc := o.Type
+		if len(o.Choices) != 0 {
+			desc += ": " + strings.Join(o.Choices, ", ")
+		}
+		if o.Source != "default" {
+			desc += "; set by " + o.Source + ", default " + optString(o.Default)
+		}
+		fmt.Fprintf(w, "%s = %s (%s)\n", o.Name, optString(o.Value), desc)
+		if o.Help != "" {
+			fmt.Fprintf(w, "    %s\n", o.Help)
+		}
+	}
+}
+
+// Returns a string representation of an option's value.
+func optString(v lua.LValue) string {
+	switch v := v.(type) {
+	case lua.LString:
+		return strconv.Quote(string(v))
+	case *lua.LTable:
+		return "{" + LArrayToString(v) + "}"
+	}
+	return LToString(v)
+}
@@ -0,0 +1,193 @@
+package knit
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/kballard/go-shellquote"
+	lua "github.com/zyedidia/gopher-lua"
+	"github.com/zyedidia/knit/rules"
+)
+
+// Environment variables that affect the results of configuration checks.
+// Checks are run again when any of them change.
+var probeEnv = []string{
+	"PATH",
+	"CC",
+	"CFLAGS",
+	"CPPFLAGS",
+	"LDFLAGS",
+	"CPATH",
+	"C_INCLUDE_PATH",
+	"LIBRARY_PATH",
+	"PKG_CONFIG",
+	"PKG_CONFIG_PATH",
+	"PKG_CONFIG_LIBDIR",
+	"PKG_CONFIG_SYSROOT_DIR",
+}
+
+// UseDatabase makes the VM memoize the results of configuration checks in
+// 'db'. Without a database, checks are run every time they are called.
+func (vm *LuaVM) UseDatabase(db *rules.Database) {
+	vm.db = db
+}
+
+// Runs the configuration check 'check', or returns its stored result if it
+// already succeeded with the same 'key' in the same environment. Failed checks
+// are not stored, so that they are run again once the missing program or
+// library has been installed.
+func (vm *LuaVM) probe(key []string, check func() rules.ProbeResult) rules.ProbeResult {
+	if vm.flags.NoCommands {
+		return rules.ProbeResult{Out: []string{"configuration checks are disabled"}}
+	}
+	for _, e := range probeEnv {
+		key = append(key, e+"="+os.Getenv(e))
+	}
+	if vm.db == nil {
+		return check()
+	}
+	if r, ok := vm.db.Probe(key); ok && !vm.flags.Always {
+		return r
+	}
+	r := check()
+	if r.OK {
+		vm.db.SetProbe(key, r)
+	}
+	return r
+}
+
+// Options for checks that use the C compiler, from an optional table with
+// the fields 'cc' and 'cflags'.
+type ccOpts struct {
+	cc     string
+	cflags []string
+}
+
+func (vm *LuaVM) ccOpts(L *lua.LState, idx int) ccOpts {
+	opts := ccOpts{cc: os.Getenv("CC")}
+	if opts.cc == "" {
+		opts.cc = "cc"
+	}
+	tbl := L.OptTable(idx, L.NewTable())
+	if cc := tbl.RawGetString("cc"); cc != lua.LNil {
+		opts.cc = LToString(cc)
+	}
+	flags := os.Getenv("CFLAGS")
+	if cflags := tbl.RawGetString("cflags"); cflags != lua.LNil {
+		flags = LToString(cflags)
+	}
+	cflags, err := shellquote.Split(flags)
+	if err != nil {
+		L.RaiseError("cflags: %v", err)
+	}
+	opts.cflags = cflags
+	return opts
+}
+
+// Compiles the C source 'src' with the compiler and flags from 'opts', and
+// the extra arguments 'args'. Returns true if the compiler succeeded.
+func compiles(opts ccOpts, src string, args ...string) bool {
+	dir, err := os.MkdirTemp("", "knit-probe")
+	if err != nil {
+		return false
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "probe.c")
+	if err := os.WriteFile(file, []byte(src), 0666); err != nil {
+		return false
+	}
+	cmdargs := append(append([]string{}, opts.cflags...), file, "-o", filepath.Join(dir, "probe"))
+	cmd := exec.Command(opts.cc, append(cmdargs, args...)...)
+	return cmd.Run() == nil
+}
+
+// Adds the configuration check functions to the 'knit' package table.
+func (vm *LuaVM) addProbes(pkg *lua.LTable) {
+	vm.L.SetField(pkg, "findprogram", vm.L.NewFunction(func(L *lua.LState) int {
+		names := make([]string, 0, L.GetTop())
+		for i := 1; i <= L.GetTop(); i++ {
+			names = append(names, L.CheckString(i))
+		}
+		r := vm.probe(append([]string{"findprogram"}, names...), func() rules.ProbeResult {
+			for _, name := range names {
+				if path, err := exec.LookPath(name); err == nil {
+					return rules.ProbeResult{OK: true, Out: []string{path}}
+				}
+			}
+			return rules.ProbeResult{
+				Out: []string{fmt.Sprintf("no program named %s found in PATH", strings.Join(names, " or "))},
+			}
+		})
+		if !r.OK {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(strings.Join(r.Out, "")))
+			return 2
+		}
+		L.Push(lua.LString(r.Out[0]))
+		return 1
+	}))
+	vm.L.SetField(pkg, "checkheader", vm.L.NewFunction(func(L *lua.LState) int {
+		header := L.CheckString(1)
+		opts := vm.ccOpts(L, 2)
+		key := append([]string{"checkheader", header, opts.cc}, opts.cflags...)
+		r := vm.probe(key, func() rules.ProbeResult {
+			return rules.ProbeResult{
+				OK: compiles(opts, fmt.Sprintf("#include <%s>\n", header), "-E"),
+			}
+		})
+		L.Push(lua.LBool(r.OK))
+		return 1
+	}))
+	vm.L.SetField(pkg, "checklib", vm.L.NewFunction(func(L *lua.LState) int {
+		lib := L.CheckString(1)
+		opts := vm.ccOpts(L, 2)
+		key := append([]string{"checklib", lib, opts.cc, os.Getenv("LDFLAGS")}, opts.cflags...)
+		r := vm.probe(key, func() rules.ProbeResult {
+			ldflags, _ := shellquote.Split(os.Getenv("LDFLAGS"))
+			return rules.ProbeResult{
+				OK: compiles(opts, "int main(void) { return 0; }\n", append(ldflags, "-l"+lib)...),
+			}
+		})
+		L.Push(lua.LBool(r.OK))
+		return 1
+	}))
+	vm.L.SetField(pkg, "pkgconfig", vm.L.NewFunction(func(L *lua.LState) int {
+		pkg := L.CheckString(1)
+		pkgconfig := os.Getenv("PKG_CONFIG")
+		if pkgconfig == "" {
+			pkgconfig = "pkg-config"
+		}
+		r := vm.probe([]string{"pkgconfig", pkg, pkgconfig}, func() rules.ProbeResult {
+			out := make([]string, 0, 2)
+			for _, flag := range []string{"--cflags", "--libs"} {
+				b, err := exec.Command(pkgconfig, flag, pkg).Output()
+				if err != nil {
+					msg := err.Error()
+					if eerr, ok := err.(*exec.ExitError); ok && len(eerr.Stderr) != 0 {
+						// the first line says what went wrong
+						msg, _, _ = strings.Cut(string(bytes.TrimSpace(eerr.Stderr)), "\n")
+					}
+					return rules.ProbeResult{
+						Out: []string{fmt.Sprintf("%s %s: %s", pkgconfig, pkg, msg)},
+					}
+				}
+				out = append(out, string(bytes.TrimSpace(b)))
+			}
+			return rules.ProbeResult{OK: true, Out: out}
+		})
+		if !r.OK {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(strings.Join(r.Out, "")))
+			return 2
+		}
+		tbl := L.NewTable()
+		L.SetField(tbl, "cflags", lua.LString(r.Out[0]))
+		L.SetField(tbl, "libs", lua.LString(r.Out[1]))
+		L.Push(tbl)
+		return 1
+	}))
+}
@@ -0,0 +1,163 @@
+package knit
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+
+	"github.com/zyedidia/knit/rules"
+)
+
+// A Project is a Knitfile that has been loaded so that it can be built from a
+// Go program. It is the structured equivalent of Run: the Knitfile's rules
+// can be inspected, build graphs can be created for any targets, and the
+// graphs can be executed with a custom printer and cancelled with a context.
+//
+// Paths are relative to the directory of the Knitfile, which must be the
+// current working directory while the project is in use (creating a graph
+// from another directory is an error). Generator rules are not built
+// automatically.
+type Project struct {
+	// absolute path of the directory of the Knitfile
+	Dir   string
+	VM    *LuaVM
+	Rules *rules.RuleSet
+	Db    *rules.Database
+	Flags Flags
+	// options for creating build graphs, including a function that is
+	// called with warnings
+	GraphOptions rules.GraphOptions
+	// called with informational messages during builds (may be nil)
+	Info rules.InfoFn
+	// runs the commands of recipes (if nil, they are run locally)
+	Runner rules.Runner
+}
+
+// Open evaluates the Knitfile 'file', which must be in the current
+// directory, with the 'cli' table holding 'vars', and opens its database. As
+// with Run, recipes are run by the internal shell if 'flags' does not specify
+// one. If it does not specify a number of threads, the number of CPUs is used.
+func Open(file string, vars map[string]string, flags Flags) (*Project, error) {
+	if err := checkVariant(flags.Variant); err != nil {
+		return nil, err
+	}
+	dir, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	if abs, err := filepath.Abs(file); err != nil || filepath.Dir(abs) != dir {
+		return nil, fmt.Errorf("%s: the Knitfile must be in the current directory", file)
+	}
+	if flags.Ncpu <= 0 {
+		flags.Ncpu = runtime.NumCPU()
+	}
+	ambiguity, err := rules.ParseAmbiguity(flags.Ambiguity)
+	if err != nil {
+		return nil, err
+	}
+
+	assigns := make([]assign, 0, len(vars))
+	for k, v := range vars {
+		assigns = append(assigns, assign{name: k, value: v})
+	}
+	sort.Slice(assigns, func(i, j int) bool {
+		return assigns[i].name < assigns[j].name
+	})
+	vm := newVM(flags, assigns)
+
+	db, err := openDatabase(file, flags)
+	if err != nil {
+		return nil, err
+	}
+	vm.UseDatabase(db)
+
+	rs, err := loadFile(vm, file)
+	if err != nil {
+		return nil, err
+	}
+	return &Project{
+		Dir:   dir,
+		VM:    vm,
+		Rules: rs,
+		Db:    db,
+		Flags: flags,
+		GraphOptions: rules.GraphOptions{
+			Ambiguity: ambiguity,
+		},
+	}, nil
+}
+
+// Graph returns the build graph for 'targets', or for the Knitfile's default
+// target if none are given, with its recipes expanded. The graph's target is
+// a virtual target named ':build' that depends on 'targets'.
+func (p *Project) Graph(targets ...string) (*rules.Graph, error) {
+	if err := p.checkDir(); err != nil {
+		return nil, err
+	}
+	if len(targets) == 0 {
+		targets = []string{p.Rules.MainTarget()}
+	}
+	rs := rules.MergeRuleSets(p.Rules, nil)
+	rs.Add(rules.NewDirectRuleBase([]string{":build"}, targets, nil, rules.AttrSet{
+		Virtual: true,
+		NoMeta:  true,
+		Rebuild: true,
+	}))
+
+	updated := make(map[string]bool)
+	for _, u := range p.Flags.Updated {
+		updated[u] = true
+	}
+	g, err := rules.NewGraph(rs, ":build", updated, p.GraphOptions)
+	if err != nil {
+		return nil, err
+	}
+	if err := g.ExpandRecipes(p.VM); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// Returns an error if the current directory is not the project's directory,
+// since the paths in the project are relative to it.
+func (p *Project) checkDir() error {
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	if wd != p.Dir {
+		return fmt.Errorf("the current directory must be the directory of the Knitfile ('%s')", p.Dir)
+	}
+	return nil
+}
+
+// NewExecutor returns an executor for the project's graphs, which prints
+// commands with 'printer' and runs them with the project's runner. Use
+// NewPrinter for one of Knit's printers.
+func (p *Project) NewExecutor(printer rules.Printer) *rules.Executor {
+	info := p.Info
+	if info == nil {
+		info = func(msg string) {}
+	}
+	opts := executorOptions(p.Flags)
+	opts.Runner = p.Runner
+	return rules.NewExecutor(".", p.Db, p.Flags.Ncpu, printer, info, opts)
+}
+
+// Build builds 'targets' (or the default target), printing commands with
+// 'printer', and saves the database. The build stops when 'ctx' is done.
+// Returns true if anything was rebuilt.
+func (p *Project) Build(ctx context.Context, printer rules.Printer, targets ...string) (bool, error) {
+	g, err := p.Graph(targets...)
+	if err != nil {
+		return false, err
+	}
+	rebuilt, err := p.NewExecutor(printer).ExecContext(ctx, g)
+	if serr := p.Db.Save(); err == nil {
+		err = serr
+	}
+	return rebuilt, err
+}
@@ -0,0 +1,109 @@
+package knit_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zyedidia/knit"
+	"github.com/zyedidia/knit/rules"
+)
+
+const projectKnitfile = `
+local knit = require("knit")
+
+return b{
+    $ prog: main.o
+        echo $input > $output
+    $ %.o: %.c
+        echo $(cli.cflags) $input > $output
+    $ slow:VB:
+        sleep 10
+}
+`
+
+func TestProject(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"Knitfile": projectKnitfile,
+		"main.c":   "int main(void) { return 0; }\n",
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Chdir(dir)
+	defer os.Chdir(wd)
+
+	p, err := knit.Open("Knitfile", map[string]string{"cflags": "-O2"}, knit.Flags{Hash: true, Shell: "sh"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := p.Graph()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, ok := g.Node("main.o")
+	if !ok {
+		t.Fatal("main.o is not in the graph")
+	}
+	if len(n.Recipe) != 1 || n.Recipe[0] != "echo -O2 main.c > main.o" {
+		t.Errorf("unexpected recipe for main.o: %q", n.Recipe)
+	}
+	if n.Rule.Line != 7 {
+		t.Errorf("expected main.o to be built by the rule on line 7, got %d", n.Rule.Line)
+	}
+	nodes := g.Nodes()
+	if len(nodes) != 4 || nodes[1].Target != "main.o" || nodes[2].Target != "prog" || nodes[3].Target != ":build" {
+		t.Errorf("unexpected nodes: %v", nodes)
+	}
+	if status, _ := g.Status("prog", p.Db, true); status != rules.NoExist {
+		t.Errorf("expected prog not to exist, got %v", status)
+	}
+
+	rebuilt, err := p.Build(context.Background(), knit.NewPrinter(io.Discard, "basic"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rebuilt {
+		t.Error("expected prog to be built")
+	}
+	data, err := os.ReadFile("prog")
+	if err != nil || string(data) != "main.o\n" {
+		t.Errorf("unexpected contents of prog: %q (%v)", data, err)
+	}
+	rebuilt, err = p.Build(context.Background(), knit.NewPrinter(io.Discard, "basic"), "prog")
+	if err != nil || rebuilt {
+		t.Errorf("expected prog to be up-to-date, got %v (%v)", rebuilt, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = p.Build(ctx, knit.NewPrinter(io.Discard, "basic"), "slow")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the build to be cancelled, got %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("the recipe was not stopped when the build was cancelled")
+	}
+
+	// paths are relative to the project's directory
+	os.Chdir(wd)
+	if _, err := p.Graph(); err == nil {
+		t.Error("expected an error when creating a graph from another directory")
+	}
+	if _, err := knit.Open(filepath.Join(dir, "Knitfile"), nil, knit.Flags{}); err == nil {
+		t.Error("expected an error when opening a Knitfile in another directory")
+	}
+}
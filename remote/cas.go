@@ -0,0 +1,407 @@
+package remote
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	bspb "google.golang.org/genproto/googleapis/bytestream"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// Blobs larger than this are transferred with the ByteStream API instead of
+// in batches, which keeps batch requests below gRPC's default message size
+// limit of 4MiB.
+const maxBatchSize = 2 << 20
+
+// Size of the chunks in which blobs are written with the ByteStream API.
+const chunkSize = 1 << 20
+
+// A blob is the contents of a serialized message, or of a file that is read
+// when it is uploaded.
+type blob struct {
+	digest *repb.Digest
+	data   []byte
+	path   string // file to read the contents from if 'data' is nil
+}
+
+func (b *blob) read() ([]byte, error) {
+	if b.data != nil {
+		return b.data, nil
+	}
+	return os.ReadFile(b.path)
+}
+
+// Returns the key of a digest in a map of blobs.
+func key(d *repb.Digest) string {
+	return fmt.Sprintf("%s/%d", d.Hash, d.SizeBytes)
+}
+
+func digestOf(data []byte) *repb.Digest {
+	sum := sha256.Sum256(data)
+	return &repb.Digest{Hash: hex.EncodeToString(sum[:]), SizeBytes: int64(len(data))}
+}
+
+func digestFile(path string) (*repb.Digest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return nil, err
+	}
+	return &repb.Digest{Hash: hex.EncodeToString(h.Sum(nil)), SizeBytes: n}, nil
+}
+
+// Serializes 'm' and adds it to 'blobs'. Serialization is deterministic so
+// that identical actions have identical digests.
+func addMessage(blobs map[string]*blob, m proto.Message) (*repb.Digest, error) {
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	d := digestOf(data)
+	blobs[key(d)] = &blob{digest: d, data: data}
+	return d, nil
+}
+
+// A tree is a directory of input files that is turned into Directory
+// messages.
+type tree struct {
+	files map[string]string // name -> path on disk
+	dirs  map[string]*tree
+}
+
+func newTree() *tree {
+	return &tree{
+		files: make(map[string]string),
+		dirs:  make(map[string]*tree),
+	}
+}
+
+// Creates the directory 'dir' (a clean relative path) in the tree and returns
+// it.
+func (t *tree) mkdir(dir string) *tree {
+	if dir == "." || dir == "" {
+		return t
+	}
+	for _, name := range strings.Split(filepath.ToSlash(dir), "/") {
+		sub, ok := t.dirs[name]
+		if !ok {
+			sub = newTree()
+			t.dirs[name] = sub
+		}
+		t = sub
+	}
+	return t
+}
+
+// Adds the file or directory at 'src' on disk to the tree at 'path'. Paths
+// that do not exist are ignored, since they may be virtual targets.
+func (t *tree) add(path, src string) error {
+	info, err := os.Stat(src)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			rel, err := filepath.Rel(src, p)
+			if err != nil {
+				return err
+			}
+			return t.add(filepath.Join(path, rel), p)
+		})
+	}
+	dir, name := filepath.Split(path)
+	t.mkdir(filepath.Clean(dir)).files[name] = src
+	return nil
+}
+
+// Returns the digest of the Directory message for the tree, and adds it, the
+// messages of its subdirectories, and its files to 'blobs'.
+func (t *tree) digest(blobs map[string]*blob) (*repb.Digest, error) {
+	dir := &repb.Directory{}
+	for name, src := range t.files {
+		d, err := digestFile(src)
+		if err != nil {
+			return nil, err
+		}
+		info, err := os.Stat(src)
+		if err != nil {
+			return nil, err
+		}
+		blobs[key(d)] = &blob{digest: d, path: src}
+		dir.Files = append(dir.Files, &repb.FileNode{
+			Name:         name,
+			Digest:       d,
+			IsExecutable: info.Mode()&0111 != 0,
+		})
+	}
+	for name, sub := range t.dirs {
+		d, err := sub.digest(blobs)
+		if err != nil {
+			return nil, err
+		}
+		dir.Directories = append(dir.Directories, &repb.DirectoryNode{Name: name, Digest: d})
+	}
+	// entries must be sorted by name
+	sort.Slice(dir.Files, func(i, j int) bool { return dir.Files[i].Name < dir.Files[j].Name })
+	sort.Slice(dir.Directories, func(i, j int) bool { return dir.Directories[i].Name < dir.Directories[j].Name })
+	return addMessage(blobs, dir)
+}
+
+// Uploads the blobs that the server does not have yet.
+func (r *Runner) upload(ctx context.Context, blobs map[string]*blob) error {
+	req := &repb.FindMissingBlobsRequest{InstanceName: r.instance}
+	for _, b := range blobs {
+		if b.digest.SizeBytes > 0 {
+			req.BlobDigests = append(req.BlobDigests, b.digest)
+		}
+	}
+	if len(req.BlobDigests) == 0 {
+		return nil
+	}
+	resp, err := r.cas.FindMissingBlobs(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	batch := &repb.BatchUpdateBlobsRequest{InstanceName: r.instance}
+	size := int64(0)
+	flush := func() error {
+		if len(batch.Requests) == 0 {
+			return nil
+		}
+		resp, err := r.cas.BatchUpdateBlobs(ctx, batch)
+		if err != nil {
+			return err
+		}
+		for _, res := range resp.Responses {
+			if err := status.ErrorProto(res.Status); err != nil {
+				return fmt.Errorf("uploading %s: %w", key(res.Digest), err)
+			}
+		}
+		batch.Requests = nil
+		size = 0
+		return nil
+	}
+	for _, d := range resp.MissingBlobDigests {
+		b, ok := blobs[key(d)]
+		if !ok {
+			return fmt.Errorf("server requested unknown blob %s", key(d))
+		}
+		data, err := b.read()
+		if err != nil {
+			return err
+		}
+		if d.SizeBytes > maxBatchSize {
+			if err := r.write(ctx, d, data); err != nil {
+				return err
+			}
+			continue
+		}
+		if size+d.SizeBytes > maxBatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		batch.Requests = append(batch.Requests, &repb.BatchUpdateBlobsRequest_Request{Digest: d, Data: data})
+		size += d.SizeBytes
+	}
+	return flush()
+}
+
+// Writes a large blob with the ByteStream API.
+func (r *Runner) write(ctx context.Context, d *repb.Digest, data []byte) error {
+	uuid := make([]byte, 16)
+	if _, err := rand.Read(uuid); err != nil {
+		return err
+	}
+	uuid[6] = uuid[6]&0x0f | 0x40
+	uuid[8] = uuid[8]&0x3f | 0x80
+	id := hex.EncodeToString(uuid)
+	name := fmt.Sprintf("uploads/%s-%s-%s-%s-%s/blobs/%s/%d", id[:8], id[8:12], id[12:16], id[16:20], id[20:], d.Hash, d.SizeBytes)
+	if r.instance != "" {
+		name = r.instance + "/" + name
+	}
+
+	stream, err := r.bs.Write(ctx)
+	if err != nil {
+		return err
+	}
+	for off := 0; ; off += chunkSize {
+		end := off + chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		req := &bspb.WriteRequest{
+			WriteOffset: int64(off),
+			Data:        data[off:end],
+			FinishWrite: end == len(data),
+		}
+		if off == 0 {
+			req.ResourceName = name
+		}
+		if err := stream.Send(req); err != nil {
+			if err == io.EOF {
+				// the server already has the blob
+				break
+			}
+			return err
+		}
+		if end == len(data) {
+			break
+		}
+	}
+	_, err = stream.CloseAndRecv()
+	return err
+}
+
+// Downloads the blobs with the digests 'digests', and returns their contents
+// by key.
+func (r *Runner) fetch(ctx context.Context, digests []*repb.Digest) (map[string][]byte, error) {
+	data := make(map[string][]byte)
+	batch := &repb.BatchReadBlobsRequest{InstanceName: r.instance}
+	size := int64(0)
+	flush := func() error {
+		if len(batch.Digests) == 0 {
+			return nil
+		}
+		resp, err := r.cas.BatchReadBlobs(ctx, batch)
+		if err != nil {
+			return err
+		}
+		for _, res := range resp.Responses {
+			if err := status.ErrorProto(res.Status); err != nil {
+				return fmt.Errorf("downloading %s: %w", key(res.Digest), err)
+			}
+			data[key(res.Digest)] = res.Data
+		}
+		batch.Digests = nil
+		size = 0
+		return nil
+	}
+	for _, d := range digests {
+		if _, ok := data[key(d)]; ok {
+			continue
+		}
+		if d.SizeBytes == 0 {
+			data[key(d)] = []byte{}
+			continue
+		}
+		if d.SizeBytes > maxBatchSize {
+			b, err := r.read(ctx, d)
+			if err != nil {
+				return nil, err
+			}
+			data[key(d)] = b
+			continue
+		}
+		if size+d.SizeBytes > maxBatchSize {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		}
+		batch.Digests = append(batch.Digests, d)
+		size += d.SizeBytes
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Reads a large blob with the ByteStream API.
+func (r *Runner) read(ctx context.Context, d *repb.Digest) ([]byte, error) {
+	name := fmt.Sprintf("blobs/%s/%d", d.Hash, d.SizeBytes)
+	if r.instance != "" {
+		name = r.instance + "/" + name
+	}
+	stream, err := r.bs.Read(ctx, &bspb.ReadRequest{ResourceName: name})
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, 0, d.SizeBytes)
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		data = append(data, resp.Data...)
+	}
+	return data, nil
+}
+
+// Writes the directory tree 'tree' to 'dir', replacing anything that was
+// there.
+func (r *Runner) writeTree(ctx context.Context, dir string, tree *repb.Tree) error {
+	// children are found by the digests of their messages
+	children := make(map[string]*repb.Directory)
+	var digests []*repb.Digest
+	for _, d := range append([]*repb.Directory{tree.Root}, tree.Children...) {
+		if d != tree.Root {
+			data, err := proto.MarshalOptions{Deterministic: true}.Marshal(d)
+			if err != nil {
+				return err
+			}
+			children[key(digestOf(data))] = d
+		}
+		for _, f := range d.Files {
+			digests = append(digests, f.Digest)
+		}
+	}
+	data, err := r.fetch(ctx, digests)
+	if err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	var write func(path string, d *repb.Directory) error
+	write = func(path string, d *repb.Directory) error {
+		if err := os.MkdirAll(path, os.ModePerm); err != nil {
+			return err
+		}
+		for _, f := range d.Files {
+			if err := writeFile(filepath.Join(path, f.Name), data[key(f.Digest)], f.IsExecutable); err != nil {
+				return err
+			}
+		}
+		for _, l := range d.Symlinks {
+			if err := os.Symlink(l.Target, filepath.Join(path, l.Name)); err != nil {
+				return err
+			}
+		}
+		for _, sub := range d.Directories {
+			c, ok := children[key(sub.Digest)]
+			if !ok {
+				return fmt.Errorf("directory %s is missing from the output tree", sub.Name)
+			}
+			if err := write(filepath.Join(path, sub.Name), c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return write(dir, tree.Root)
+}
@@ -0,0 +1,361 @@
+// Package remote runs the commands of Knit recipes on a server that supports
+// the Remote Execution API (REAPI), such as Buildbarn, BuildGrid, or
+// NativeLink. Each command is sent as an action made of the command line, its
+// environment, and a tree of its input files, which are uploaded to the
+// server's content-addressable storage. The outputs of the action are
+// downloaded back into the build directory once it has run.
+package remote
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/zyedidia/knit/rules"
+	bspb "google.golang.org/genproto/googleapis/bytestream"
+	"google.golang.org/genproto/googleapis/longrunning"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// A Runner runs commands on a remote execution server. Commands must declare
+// all of the files that they read as inputs, since nothing else is available
+// to them. Paths are relative to the current working directory, which must be
+// the directory that Knit runs in.
+type Runner struct {
+	// Platform properties that select the workers that may run commands.
+	Platform map[string]string
+
+	instance string
+	conn     *grpc.ClientConn
+	cas      repb.ContentAddressableStorageClient
+	exec     repb.ExecutionClient
+	bs       bspb.ByteStreamClient
+}
+
+// New returns a runner that uses the server connected to with 'conn', and the
+// instance 'instance' on it (which may be empty).
+func New(conn grpc.ClientConnInterface, instance string) *Runner {
+	return &Runner{
+		instance: instance,
+		cas:      repb.NewContentAddressableStorageClient(conn),
+		exec:     repb.NewExecutionClient(conn),
+		bs:       bspb.NewByteStreamClient(conn),
+	}
+}
+
+// Dial connects to the server at 'target' (of the form 'host:port', with an
+// optional 'grpc://' or 'grpcs://' scheme for plain or TLS connections) and
+// returns a runner that uses its instance 'instance'.
+func Dial(target, instance string) (*Runner, error) {
+	creds := insecure.NewCredentials()
+	if strings.HasPrefix(target, "grpcs://") {
+		creds = credentials.NewTLS(&tls.Config{})
+	}
+	target = strings.TrimPrefix(strings.TrimPrefix(target, "grpcs://"), "grpc://")
+	conn, err := grpc.Dial(target, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, err
+	}
+	r := New(conn, instance)
+	r.conn = conn
+	return r, nil
+}
+
+// Close closes the connection opened by Dial.
+func (r *Runner) Close() error {
+	if r.conn == nil {
+		return nil
+	}
+	return r.conn.Close()
+}
+
+// Inputs outside of the build directory (such as the scripts for recipes with
+// an interpreter) are placed in this directory of the input root, named by
+// their digests so that actions do not depend on their original names.
+const externalDir = ".knit-remote"
+
+func (r *Runner) Run(ctx context.Context, c rules.Command) error {
+	root, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	dir := filepath.Clean(c.Dir)
+	if filepath.IsAbs(dir) || isOutside(dir) {
+		return fmt.Errorf("remote execution: directory '%s' is outside of the build directory", c.Dir)
+	}
+
+	in := newTree()
+	in.mkdir(dir)
+	// arguments that refer to external inputs are replaced by their paths
+	// in the input root
+	external := make(map[string]string)
+	for _, p := range c.Inputs {
+		path, src := p, filepath.Join(root, p)
+		if filepath.IsAbs(p) {
+			rel, err := filepath.Rel(root, p)
+			if err != nil || isOutside(rel) {
+				d, err := digestFile(p)
+				if err != nil {
+					return err
+				}
+				rel = filepath.Join(externalDir, d.Hash)
+				external[p] = rel
+			}
+			path, src = rel, p
+		}
+		path = filepath.Clean(path)
+		if isOutside(path) {
+			return fmt.Errorf("remote execution: input '%s' is outside of the build directory", p)
+		}
+		if err := in.add(path, src); err != nil {
+			return err
+		}
+	}
+
+	name := c.Name
+	if filepath.IsAbs(name) {
+		// the worker may have the program in a different location
+		name = filepath.Base(name)
+	}
+	args := []string{name}
+	for _, a := range c.Args {
+		if rel, ok := external[a]; ok {
+			a = relPath(dir, rel)
+		}
+		args = append(args, a)
+	}
+
+	cmd := &repb.Command{
+		Arguments:        args,
+		WorkingDirectory: slashPath(dir),
+		Platform:         r.platform(),
+	}
+	env := append([]string{}, c.Env...)
+	sort.Strings(env)
+	for _, e := range env {
+		k, v, _ := strings.Cut(e, "=")
+		cmd.EnvironmentVariables = append(cmd.EnvironmentVariables, &repb.Command_EnvironmentVariable{
+			Name:  k,
+			Value: v,
+		})
+	}
+	outs := make(map[string]bool)
+	for _, o := range c.Outputs {
+		outs[slashPath(relPath(dir, filepath.Clean(o)))] = true
+	}
+	for o := range outs {
+		cmd.OutputPaths = append(cmd.OutputPaths, o)
+	}
+	sort.Strings(cmd.OutputPaths)
+
+	blobs := make(map[string]*blob)
+	rootDigest, err := in.digest(blobs)
+	if err != nil {
+		return err
+	}
+	cmdDigest, err := addMessage(blobs, cmd)
+	if err != nil {
+		return err
+	}
+	actionDigest, err := addMessage(blobs, &repb.Action{
+		CommandDigest:   cmdDigest,
+		InputRootDigest: rootDigest,
+	})
+	if err != nil {
+		return err
+	}
+	if err := r.upload(ctx, blobs); err != nil {
+		return fmt.Errorf("remote execution: %w", err)
+	}
+
+	res, err := r.execute(ctx, actionDigest)
+	if err != nil {
+		return fmt.Errorf("remote execution: %w", err)
+	}
+	if err := r.writeOutputs(ctx, filepath.Join(root, dir), res); err != nil {
+		return fmt.Errorf("remote execution: %w", err)
+	}
+	if err := r.writeStream(ctx, c.Stdout, res.StdoutRaw, res.StdoutDigest); err != nil {
+		return err
+	}
+	if err := r.writeStream(ctx, c.Stderr, res.StderrRaw, res.StderrDigest); err != nil {
+		return err
+	}
+	if res.ExitCode != 0 {
+		return fmt.Errorf("exit status %d", res.ExitCode)
+	}
+	return nil
+}
+
+// Returns the platform properties, sorted by name as required by the API.
+func (r *Runner) platform() *repb.Platform {
+	if len(r.Platform) == 0 {
+		return nil
+	}
+	p := &repb.Platform{}
+	for k, v := range r.Platform {
+		p.Properties = append(p.Properties, &repb.Platform_Property{Name: k, Value: v})
+	}
+	sort.Slice(p.Properties, func(i, j int) bool {
+		return p.Properties[i].Name < p.Properties[j].Name
+	})
+	return p
+}
+
+// Executes the action with the digest 'action' and returns its result, which
+// may come from the server's action cache.
+func (r *Runner) execute(ctx context.Context, action *repb.Digest) (*repb.ActionResult, error) {
+	stream, err := r.exec.Execute(ctx, &repb.ExecuteRequest{
+		InstanceName: r.instance,
+		ActionDigest: action,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var op *longrunning.Operation
+	for op == nil || !op.Done {
+		next, err := stream.Recv()
+		if err == io.EOF && op != nil {
+			// the server may end the stream before the operation is done,
+			// in which case it must be waited for again
+			stream, err = r.exec.WaitExecution(ctx, &repb.WaitExecutionRequest{Name: op.Name})
+			if err != nil {
+				return nil, err
+			}
+			continue
+		} else if err == io.EOF {
+			return nil, errors.New("server did not return an operation")
+		} else if err != nil {
+			return nil, err
+		}
+		op = next
+	}
+	if e := op.GetError(); e != nil {
+		return nil, status.ErrorProto(e)
+	}
+	resp := &repb.ExecuteResponse{}
+	if err := op.GetResponse().UnmarshalTo(resp); err != nil {
+		return nil, err
+	}
+	if err := status.ErrorProto(resp.Status); err != nil {
+		return nil, err
+	}
+	if resp.Result == nil {
+		return nil, errors.New("server did not return a result")
+	}
+	return resp.Result, nil
+}
+
+// Writes the output files, directories, and symlinks of 'res' into 'dir',
+// replacing existing files.
+func (r *Runner) writeOutputs(ctx context.Context, dir string, res *repb.ActionResult) error {
+	digests := make([]*repb.Digest, 0, len(res.OutputFiles)+len(res.OutputDirectories))
+	for _, f := range res.OutputFiles {
+		if f.Contents == nil {
+			digests = append(digests, f.Digest)
+		}
+	}
+	for _, d := range res.OutputDirectories {
+		digests = append(digests, d.TreeDigest)
+	}
+	data, err := r.fetch(ctx, digests)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range res.OutputFiles {
+		contents := f.Contents
+		if contents == nil {
+			contents = data[key(f.Digest)]
+		}
+		if err := writeFile(filepath.Join(dir, f.Path), contents, f.IsExecutable); err != nil {
+			return err
+		}
+	}
+	for _, d := range res.OutputDirectories {
+		tree := &repb.Tree{}
+		if err := proto.Unmarshal(data[key(d.TreeDigest)], tree); err != nil {
+			return err
+		}
+		if err := r.writeTree(ctx, filepath.Join(dir, d.Path), tree); err != nil {
+			return err
+		}
+	}
+	symlinks := append(append(append([]*repb.OutputSymlink{}, res.OutputSymlinks...), res.OutputFileSymlinks...), res.OutputDirectorySymlinks...)
+	for _, l := range symlinks {
+		path := filepath.Join(dir, l.Path)
+		if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			return err
+		}
+		os.RemoveAll(path)
+		if err := os.Symlink(l.Target, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Writes 'stream' (given inline as 'raw' or by its digest) to 'w'.
+func (r *Runner) writeStream(ctx context.Context, w io.Writer, raw []byte, d *repb.Digest) error {
+	if raw == nil && d != nil && d.SizeBytes > 0 {
+		data, err := r.fetch(ctx, []*repb.Digest{d})
+		if err != nil {
+			return fmt.Errorf("remote execution: %w", err)
+		}
+		raw = data[key(d)]
+	}
+	if w == nil || len(raw) == 0 {
+		return nil
+	}
+	_, err := w.Write(raw)
+	return err
+}
+
+// Returns true if the clean relative path 'path' is outside of the current
+// directory.
+func isOutside(path string) bool {
+	return path == ".." || strings.HasPrefix(path, ".."+string(filepath.Separator))
+}
+
+// Returns 'path' relative to 'dir', where both are relative to the same
+// directory.
+func relPath(dir, path string) string {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return path
+	}
+	return rel
+}
+
+// Returns 'path' with forward slashes, and an empty path for the current
+// directory, as used by the API.
+func slashPath(path string) string {
+	if path == "." {
+		return ""
+	}
+	return filepath.ToSlash(path)
+}
+
+func writeFile(path string, data []byte, executable bool) error {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	perm := os.FileMode(0666)
+	if executable {
+		perm = 0777
+	}
+	// remove the file first so that its permissions are reset
+	os.RemoveAll(path)
+	return os.WriteFile(path, data, perm)
+}
@@ -0,0 +1,388 @@
+package remote_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/zyedidia/knit"
+	"github.com/zyedidia/knit/remote"
+	bspb "google.golang.org/genproto/googleapis/bytestream"
+	"google.golang.org/genproto/googleapis/longrunning"
+	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// A server is a stand-in for a remote execution service, which stores blobs
+// in memory and runs each action in a new temporary directory.
+type server struct {
+	repb.UnimplementedContentAddressableStorageServer
+	repb.UnimplementedExecutionServer
+	bspb.UnimplementedByteStreamServer
+
+	t     *testing.T
+	lock  sync.Mutex
+	blobs map[string][]byte
+	// arguments of the commands that were executed
+	executed [][]string
+}
+
+func digestOf(data []byte) *repb.Digest {
+	sum := sha256.Sum256(data)
+	return &repb.Digest{Hash: hex.EncodeToString(sum[:]), SizeBytes: int64(len(data))}
+}
+
+func key(d *repb.Digest) string {
+	return fmt.Sprintf("%s/%d", d.Hash, d.SizeBytes)
+}
+
+func (s *server) put(data []byte) *repb.Digest {
+	d := digestOf(data)
+	s.lock.Lock()
+	s.blobs[key(d)] = data
+	s.lock.Unlock()
+	return d
+}
+
+func (s *server) get(d *repb.Digest) ([]byte, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	data, ok := s.blobs[key(d)]
+	if !ok && d.SizeBytes == 0 {
+		return []byte{}, true
+	}
+	return data, ok
+}
+
+func (s *server) getMessage(d *repb.Digest, m proto.Message) error {
+	data, ok := s.get(d)
+	if !ok {
+		return status.Errorf(codes.FailedPrecondition, "missing blob %s", key(d))
+	}
+	return proto.Unmarshal(data, m)
+}
+
+func (s *server) putMessage(m proto.Message) *repb.Digest {
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(m)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return s.put(data)
+}
+
+func (s *server) FindMissingBlobs(ctx context.Context, req *repb.FindMissingBlobsRequest) (*repb.FindMissingBlobsResponse, error) {
+	resp := &repb.FindMissingBlobsResponse{}
+	for _, d := range req.BlobDigests {
+		if _, ok := s.get(d); !ok {
+			resp.MissingBlobDigests = append(resp.MissingBlobDigests, d)
+		}
+	}
+	return resp, nil
+}
+
+func (s *server) BatchUpdateBlobs(ctx context.Context, req *repb.BatchUpdateBlobsRequest) (*repb.BatchUpdateBlobsResponse, error) {
+	resp := &repb.BatchUpdateBlobsResponse{}
+	for _, r := range req.Requests {
+		st := &rpcstatus.Status{}
+		if key(digestOf(r.Data)) != key(r.Digest) {
+			st.Code = int32(codes.InvalidArgument)
+		} else {
+			s.put(r.Data)
+		}
+		resp.Responses = append(resp.Responses, &repb.BatchUpdateBlobsResponse_Response{Digest: r.Digest, Status: st})
+	}
+	return resp, nil
+}
+
+func (s *server) BatchReadBlobs(ctx context.Context, req *repb.BatchReadBlobsRequest) (*repb.BatchReadBlobsResponse, error) {
+	resp := &repb.BatchReadBlobsResponse{}
+	for _, d := range req.Digests {
+		data, ok := s.get(d)
+		st := &rpcstatus.Status{}
+		if !ok {
+			st.Code = int32(codes.NotFound)
+		}
+		resp.Responses = append(resp.Responses, &repb.BatchReadBlobsResponse_Response{Digest: d, Data: data, Status: st})
+	}
+	return resp, nil
+}
+
+func (s *server) Write(stream bspb.ByteStream_WriteServer) error {
+	buf := &bytes.Buffer{}
+	for {
+		req, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		buf.Write(req.Data)
+		if req.FinishWrite {
+			break
+		}
+	}
+	s.put(buf.Bytes())
+	return stream.SendAndClose(&bspb.WriteResponse{CommittedSize: int64(buf.Len())})
+}
+
+func (s *server) Read(req *bspb.ReadRequest, stream bspb.ByteStream_ReadServer) error {
+	parts := strings.Split(req.ResourceName, "/")
+	if len(parts) < 3 || parts[len(parts)-3] != "blobs" {
+		return status.Errorf(codes.InvalidArgument, "invalid resource name %s", req.ResourceName)
+	}
+	s.lock.Lock()
+	data, ok := s.blobs[parts[len(parts)-2]+"/"+parts[len(parts)-1]]
+	s.lock.Unlock()
+	if !ok {
+		return status.Errorf(codes.NotFound, "missing blob %s", req.ResourceName)
+	}
+	for len(data) > 0 {
+		n := len(data)
+		if n > 1<<20 {
+			n = 1 << 20
+		}
+		if err := stream.Send(&bspb.ReadResponse{Data: data[:n]}); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// Writes the input directory with the digest 'd' to 'path'.
+func (s *server) checkout(d *repb.Digest, path string) error {
+	dir := &repb.Directory{}
+	if err := s.getMessage(d, dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path, os.ModePerm); err != nil {
+		return err
+	}
+	for _, f := range dir.Files {
+		data, ok := s.get(f.Digest)
+		if !ok {
+			return status.Errorf(codes.FailedPrecondition, "missing blob %s", key(f.Digest))
+		}
+		perm := os.FileMode(0666)
+		if f.IsExecutable {
+			perm = 0777
+		}
+		if err := os.WriteFile(filepath.Join(path, f.Name), data, perm); err != nil {
+			return err
+		}
+	}
+	for _, sub := range dir.Directories {
+		if err := s.checkout(sub.Digest, filepath.Join(path, sub.Name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stores the output directory at 'path' and returns its Directory message,
+// adding the messages of its subdirectories to 'tree'.
+func (s *server) storeDir(path string, tree *repb.Tree) (*repb.Directory, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	dir := &repb.Directory{}
+	for _, e := range entries {
+		p := filepath.Join(path, e.Name())
+		if e.IsDir() {
+			sub, err := s.storeDir(p, tree)
+			if err != nil {
+				return nil, err
+			}
+			tree.Children = append(tree.Children, sub)
+			dir.Directories = append(dir.Directories, &repb.DirectoryNode{Name: e.Name(), Digest: s.putMessage(sub)})
+			continue
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		dir.Files = append(dir.Files, &repb.FileNode{Name: e.Name(), Digest: s.put(data)})
+	}
+	return dir, nil
+}
+
+func (s *server) Execute(req *repb.ExecuteRequest, stream repb.Execution_ExecuteServer) error {
+	action := &repb.Action{}
+	if err := s.getMessage(req.ActionDigest, action); err != nil {
+		return err
+	}
+	cmd := &repb.Command{}
+	if err := s.getMessage(action.CommandDigest, cmd); err != nil {
+		return err
+	}
+	root := s.t.TempDir()
+	if err := s.checkout(action.InputRootDigest, root); err != nil {
+		return err
+	}
+	wd := filepath.Join(root, cmd.WorkingDirectory)
+	for _, o := range cmd.OutputPaths {
+		os.MkdirAll(filepath.Dir(filepath.Join(wd, o)), os.ModePerm)
+	}
+
+	s.lock.Lock()
+	s.executed = append(s.executed, cmd.Arguments)
+	s.lock.Unlock()
+
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	c := exec.Command(cmd.Arguments[0], cmd.Arguments[1:]...)
+	c.Dir = wd
+	c.Env = []string{"PATH=" + os.Getenv("PATH")}
+	for _, e := range cmd.EnvironmentVariables {
+		c.Env = append(c.Env, e.Name+"="+e.Value)
+	}
+	c.Stdout, c.Stderr = stdout, stderr
+	res := &repb.ActionResult{}
+	var exit *exec.ExitError
+	if err := c.Run(); errors.As(err, &exit) {
+		res.ExitCode = int32(exit.ExitCode())
+	} else if err != nil {
+		return err
+	}
+	res.StdoutDigest = s.put(stdout.Bytes())
+	res.StderrDigest = s.put(stderr.Bytes())
+
+	for _, o := range cmd.OutputPaths {
+		p := filepath.Join(wd, o)
+		info, err := os.Stat(p)
+		if err != nil {
+			continue
+		}
+		if info.IsDir() {
+			tree := &repb.Tree{}
+			tree.Root, err = s.storeDir(p, tree)
+			if err != nil {
+				return err
+			}
+			res.OutputDirectories = append(res.OutputDirectories, &repb.OutputDirectory{Path: o, TreeDigest: s.putMessage(tree)})
+			continue
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		res.OutputFiles = append(res.OutputFiles, &repb.OutputFile{Path: o, Digest: s.put(data), IsExecutable: info.Mode()&0111 != 0})
+	}
+
+	resp, err := anypb.New(&repb.ExecuteResponse{Result: res})
+	if err != nil {
+		return err
+	}
+	return stream.Send(&longrunning.Operation{
+		Name:   "operations/" + req.ActionDigest.Hash,
+		Done:   true,
+		Result: &longrunning.Operation_Response{Response: resp},
+	})
+}
+
+// Starts a stand-in server and returns a runner connected to it.
+func startServer(t *testing.T) (*server, *remote.Runner) {
+	s := &server{t: t, blobs: make(map[string][]byte)}
+	lis := bufconn.Listen(1 << 20)
+	gs := grpc.NewServer()
+	repb.RegisterContentAddressableStorageServer(gs, s)
+	repb.RegisterExecutionServer(gs, s)
+	bspb.RegisterByteStreamServer(gs, s)
+	go gs.Serve(lis)
+	t.Cleanup(gs.Stop)
+
+	conn, err := grpc.Dial("bufnet", grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+		return lis.Dial()
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return s, remote.New(conn, "")
+}
+
+const remoteKnitfile = `
+return b{
+    $ prog: main.o big.bin
+        cat main.o > $output
+        cat big.bin >> $output
+    $ %.o: %.c
+        tr a-z A-Z < $input > $output
+    $ big.bin: big.in
+        cat $input > $output
+    $ gen/data.txt:X[sh]:
+        echo generated > gen/data.txt
+    $ fail:VB:
+        echo oops >&2; exit 3
+}
+`
+
+func TestRemote(t *testing.T) {
+	dir := t.TempDir()
+	// larger than a batch, so that it is transferred with the ByteStream API
+	big := bytes.Repeat([]byte("x"), 3<<20)
+	files := map[string][]byte{
+		"Knitfile": []byte(remoteKnitfile),
+		"main.c":   []byte("int main(void) { return 0; }\n"),
+		"big.in":   big,
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Chdir(dir)
+	defer os.Chdir(wd)
+
+	s, runner := startServer(t)
+	p, err := knit.Open("Knitfile", nil, knit.Flags{Hash: true, Ncpu: 1, Shell: "sh"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Runner = runner
+
+	printer := knit.NewPrinter(io.Discard, "basic")
+	if _, err := p.Build(context.Background(), printer, "prog", "gen/data.txt"); err != nil {
+		t.Fatal(err)
+	}
+	expected := append([]byte("INT MAIN(VOID) { RETURN 0; }\n"), big...)
+	if data, err := os.ReadFile("prog"); err != nil || !bytes.Equal(data, expected) {
+		t.Errorf("prog was not built correctly (%v)", err)
+	}
+	if data, err := os.ReadFile("gen/data.txt"); err != nil || string(data) != "generated\n" {
+		t.Errorf("unexpected contents of gen/data.txt: %q (%v)", data, err)
+	}
+	if len(s.executed) != 5 {
+		t.Errorf("expected 5 commands to be executed remotely, got %d: %q", len(s.executed), s.executed)
+	}
+	for _, args := range s.executed {
+		if args[0] != "sh" {
+			t.Errorf("expected commands to be run with sh, got %q", args)
+		}
+	}
+
+	_, err = p.Build(context.Background(), printer, "fail")
+	if err == nil || !strings.Contains(err.Error(), "exit status 3") {
+		t.Errorf("expected the remote command to fail with exit status 3, got %v", err)
+	}
+}
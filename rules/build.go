@@ -1,18 +1,20 @@
 package rules
 
 import (
-	"bufio"
+	"bytes"
+	"context"
 	"fmt"
-	"io"
 	"log"
 	"os"
-	"os/exec"
-	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
-	"syscall"
+	"time"
+
+	"github.com/kballard/go-shellquote"
+	"mvdan.cc/sh/syntax"
 )
 
 type Printer interface {
@@ -29,9 +31,16 @@ type InfoFn func(msg string)
 type Options struct {
 	NoExec       bool   // don't execute recipes
 	Shell        string // use shell for executing commands
+	OneShell     bool   // run each recipe as a single script in one shell
 	AbortOnError bool   // stop if an error happens in a recipe
 	BuildAll     bool   // build all rules even if they are up-to-date
 	Hash         bool   // use hashes to determine whether a file has been modified
+	Runner       Runner // runs the commands of recipes (LocalRunner if nil)
+	// container runtime for rules with an image (podman or docker if empty)
+	Container string
+	// files that were already built during this run, which BuildAll does not
+	// build again; files built by the executor are added to it
+	Built map[string]bool
 }
 
 type Executor struct {
@@ -50,11 +59,22 @@ type Executor struct {
 	rebuilt atomic.Bool
 	err     error
 
+	// graph being executed, which may be extended by dyndep files
+	graph *Graph
+	// cancels the build and any running commands when it is done
+	ctx    context.Context
+	runner Runner
+
 	opts Options
 }
 
 func NewExecutor(basedir string, db *Database, threads int, printer Printer, info InfoFn, opts Options) *Executor {
+	runner := opts.Runner
+	if runner == nil {
+		runner = LocalRunner{}
+	}
 	return &Executor{
+		runner:  runner,
 		db:      db,
 		printer: printer,
 		opts:    opts,
@@ -69,23 +89,47 @@ type command struct {
 	args   []string
 	recipe string
 	dir    string
+	env    []string
+
+	// node whose recipe is run, and files outside of its directory that the
+	// command uses, which must be mounted if it runs in a container
+	node  *node
+	files []string
+	// true if earlier commands of the recipe have run, so the command may
+	// read the outputs that they wrote
+	later bool
 }
 
 // Exec runs all commands and returns true if something was rebuilt.
 func (e *Executor) Exec(g *Graph) (bool, error) {
-	e.steps = g.steps(e.db, e.opts.BuildAll, e.opts.Hash)
-	e.printer.SetSteps(e.steps)
+	return e.ExecContext(context.Background(), g)
+}
 
-	// make sure ctrl-c doesn't kill this process, just the children
-	if !e.opts.NoExec {
-		sig := make(chan os.Signal, 1)
-		signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGHUP)
-	}
+// ExecContext is like Exec, but stops the build when 'ctx' is done. Commands
+// that are running are killed, no more commands are started, and the
+// context's error is returned. The executor does not handle signals, so
+// programs that should stop the build on ctrl-c must cancel 'ctx' (for
+// example with signal.NotifyContext).
+func (e *Executor) ExecContext(ctx context.Context, g *Graph) (bool, error) {
+	e.graph = g
+	e.ctx = ctx
+	e.steps = g.steps(e.db, e.buildAll, e.opts.Hash)
+	e.printer.SetSteps(e.steps)
 
 	for i := 0; i < e.threads; i++ {
 		go e.runServer()
 	}
 
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-ctx.Done():
+			e.stopped.Store(true)
+		case <-finished:
+		}
+	}()
+
 	// send all jobs into e.jobs
 	e.execNode(g.base)
 
@@ -95,9 +139,29 @@ func (e *Executor) Exec(g *Graph) (bool, error) {
 	// no more jobs to send
 	close(e.jobs)
 
+	if err := ctx.Err(); err != nil {
+		return e.rebuilt.Load(), err
+	}
 	return e.rebuilt.Load(), e.err
 }
 
+// Returns true if 'n' must be built even if it is up-to-date, because all
+// rules are being built and 'n' has not been built yet during this run.
+func (e *Executor) buildAll(n *node) bool {
+	if !e.opts.BuildAll {
+		return false
+	}
+	if len(n.outputs) == 0 {
+		return true
+	}
+	for _, o := range n.outputs {
+		if !e.opts.Built[o.name] {
+			return true
+		}
+	}
+	return false
+}
+
 func (e *Executor) execNode(n *node) {
 	e.lock.Lock()
 	if n.done {
@@ -106,7 +170,7 @@ func (e *Executor) execNode(n *node) {
 	}
 
 	ood := n.outOfDate(e.db, e.opts.Hash, false)
-	if !e.opts.BuildAll && !n.rule.attrs.Linked && ood == UpToDate {
+	if !e.buildAll(n) && !n.rule.attrs.Linked && ood == UpToDate {
 		n.setDone(e.db, e.opts.NoExec, e.opts.Hash)
 		e.lock.Unlock()
 		return
@@ -126,10 +190,26 @@ func (e *Executor) execNode(n *node) {
 			p.wait()
 		}
 
+		if n.rule.attrs.Dyndep != "" && !e.stopped.Load() {
+			if err := e.loadDyndep(n); err != nil {
+				e.lock.Lock()
+				if e.err == nil {
+					e.err = &LocationError{
+						Location: n.rule.location(),
+						Err:      fmt.Errorf("'%s': %w", strings.Join(n.rule.targets, " "), err),
+					}
+				}
+				e.stopped.Store(true)
+				n.setDoneOrErr()
+				e.lock.Unlock()
+				return
+			}
+		}
+
 		e.lock.Lock()
 		// Cannot do dynamic step elision if hashing is disabled.
 		ood := n.outOfDate(e.db, e.opts.Hash, e.opts.Hash)
-		if !e.opts.BuildAll && !n.rule.attrs.Linked && (ood == UpToDate || ood == UpToDateDynamic) {
+		if !e.buildAll(n) && !n.rule.attrs.Linked && (ood == UpToDate || ood == UpToDateDynamic) {
 			done := n.setDone(e.db, e.opts.NoExec, e.opts.Hash)
 			if !done && ood == UpToDateDynamic && len(n.rule.recipe) != 0 {
 				log.Println(n.rule.targets, "elided")
@@ -168,6 +248,34 @@ func (e *Executor) execNode(n *node) {
 	}
 }
 
+// Adds the prereqs listed in the dyndep file of 'n' to the graph, and builds
+// the ones that were not already prereqs. Called once the prereqs of 'n'
+// (including the one that builds the dyndep file) are done.
+func (e *Executor) loadDyndep(n *node) error {
+	e.lock.Lock()
+	// in a dry run, the dyndep file might not have been built
+	added, err := e.graph.addDyndeps(n, e.opts.NoExec)
+	if err == nil && len(added) != 0 {
+		counted := make(map[*info]bool)
+		for _, p := range added {
+			e.steps += p.count(e.db, e.buildAll, e.opts.Hash, counted)
+		}
+		e.printer.SetSteps(e.steps)
+	}
+	e.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for _, p := range added {
+		e.execNode(p)
+	}
+	for _, p := range added {
+		p.wait()
+	}
+	return nil
+}
+
 func (e *Executor) runServer() {
 	for n := range e.jobs {
 		if len(n.rule.recipe) == 0 {
@@ -208,39 +316,32 @@ func (e *Executor) runServer() {
 			}
 		}
 
+		// the directories built by 'n' are up to date with the files that
+		// were modified before its recipe started
+		var started time.Time
+		if n.rule.attrs.Tree && !e.opts.NoExec {
+			started = fsNow()
+		}
+
 		// Lock is to ensure steps are printed in order
 		e.lock.Lock()
 		step := e.step.Add(1)
 
-		failed := false
+		var failed bool
 		var execErr error
-		for i, cmd := range n.recipe {
-			c, err := e.getCmd(cmd, n.dir)
-			if err != nil {
-				execErr = fmt.Errorf("'%s': error while evaluating '%s': %w", ruleName, cmd, err)
-				failed = true
-				break
-			} else if c.recipe == "" {
-				continue
-			}
-			if !n.rule.attrs.Quiet {
-				e.printer.Print(c.recipe, c.dir, ruleName, int(step))
-			}
-			if i == 0 {
-				e.lock.Unlock()
-			}
-			if !e.opts.NoExec {
-				err := e.execCmd(c)
-				if err != nil {
-					execErr = fmt.Errorf("'%s': error during recipe: %w", strings.Join(n.rule.targets, " "), err)
-					if e.opts.AbortOnError && !n.rule.attrs.NonStop {
-						failed = true
-						break
-					}
-				}
-			}
+		if n.rule.opts.Func != nil {
+			failed, execErr = e.runFunc(n, ruleName, int(step))
+		} else if interp := n.interpreter(); interp != nil {
+			failed, execErr = e.runInterp(n, interp, ruleName, int(step))
+		} else if n.rule.attrs.OneShell || e.opts.OneShell {
+			failed, execErr = e.runOneShell(n, ruleName, int(step))
+		} else {
+			failed, execErr = e.runRecipe(n, ruleName, int(step))
 		}
 		e.printer.Done(ruleName)
+		if execErr != nil && n.rule.file != "" {
+			execErr = &LocationError{Location: n.rule.location(), Err: execErr}
+		}
 
 		e.lock.Lock()
 
@@ -258,7 +359,17 @@ func (e *Executor) runServer() {
 			e.err = execErr
 			n.setDoneOrErr()
 		} else {
+			if n.rule.attrs.Tree && !e.opts.NoExec {
+				for _, o := range n.outputs {
+					e.db.SetTreeTime(o.name, started)
+				}
+			}
 			n.setDone(e.db, e.opts.NoExec, e.opts.Hash)
+			if e.opts.Built != nil {
+				for _, o := range n.outputs {
+					e.opts.Built[o.name] = true
+				}
+			}
 		}
 
 		e.rebuilt.Store(true)
@@ -266,13 +377,220 @@ func (e *Executor) runServer() {
 	}
 }
 
-func (e *Executor) getCmd(cmd string, dir string) (command, error) {
+// Runs each command in the recipe for 'n' as a separate process. Must be
+// called with the executor lock held, and releases it once the first command
+// has been printed.
+func (e *Executor) runRecipe(n *node, ruleName string, step int) (failed bool, execErr error) {
+	for i, cmd := range n.recipe {
+		c, err := e.getCmd(cmd, n)
+		if err != nil {
+			execErr = fmt.Errorf("'%s': error while evaluating '%s': %w", ruleName, cmd, err)
+			failed = true
+			break
+		} else if c.recipe == "" {
+			continue
+		}
+		if !n.rule.attrs.Quiet {
+			e.printer.Print(c.recipe, c.dir, ruleName, step)
+		}
+		if i == 0 {
+			e.lock.Unlock()
+		}
+		if !e.opts.NoExec {
+			c.later = i > 0
+			err := e.execCmd(c)
+			if err != nil {
+				execErr = fmt.Errorf("'%s': error during recipe: %w", strings.Join(n.rule.targets, " "), err)
+				if e.opts.AbortOnError && !n.rule.attrs.NonStop {
+					failed = true
+					break
+				}
+			}
+		}
+	}
+	return failed, execErr
+}
+
+// Runs the entire recipe for 'n' as a single script in one shell process,
+// stopping at the first command that fails (unless the rule is non-stop).
+// Must be called with the executor lock held, and releases it once the
+// commands have been printed.
+func (e *Executor) runOneShell(n *node, ruleName string, step int) (bool, error) {
+	var status *os.File
+	if !e.opts.NoExec {
+		var err error
+		status, err = os.CreateTemp("", "knit-status-")
+		if err != nil {
+			e.lock.Unlock()
+			return true, fmt.Errorf("'%s': %w", ruleName, err)
+		}
+		status.Close()
+		defer os.Remove(status.Name())
+	}
+
+	script := ""
+	if status != nil {
+		script = oneShellScript(n.recipe, status.Name(), !n.rule.attrs.NonStop)
+	}
+	c, err := e.getCmd(script, n)
+	if err != nil {
+		e.lock.Unlock()
+		return true, fmt.Errorf("'%s': error while evaluating recipe: %w", ruleName, err)
+	}
+	if !n.rule.attrs.Quiet {
+		for _, cmd := range n.recipe {
+			e.printer.Print(cmd, c.dir, ruleName, step)
+		}
+	}
+	e.lock.Unlock()
+
+	if e.opts.NoExec {
+		return false, nil
+	}
+	c.files = []string{status.Name()}
+	err = e.execCmd(c)
+	if err == nil {
+		return false, nil
+	}
+	data, _ := os.ReadFile(status.Name())
+	if i, perr := strconv.Atoi(strings.TrimSpace(string(data))); perr == nil && i >= 0 && i < len(n.recipe) {
+		err = fmt.Errorf("'%s': error during recipe at '%s': %w", ruleName, n.recipe[i], err)
+	} else {
+		err = fmt.Errorf("'%s': error during recipe: %w", ruleName, err)
+	}
+	return e.opts.AbortOnError && !n.rule.attrs.NonStop, err
+}
+
+// Runs the recipe function for 'n'. Must be called with the executor lock
+// held, and releases it once the recipe has been printed.
+func (e *Executor) runFunc(n *node, ruleName string, step int) (bool, error) {
+	if !n.rule.attrs.Quiet {
+		e.printer.Print(n.recipe[0], n.dir, ruleName, step)
+	}
+	e.lock.Unlock()
+
+	if e.opts.NoExec {
+		return false, nil
+	}
+	err := n.rule.opts.Func.Call(n.recipeContext())
+	if err != nil {
+		return e.opts.AbortOnError && !n.rule.attrs.NonStop, fmt.Errorf("'%s': error during recipe: %w", ruleName, err)
+	}
+	return false, nil
+}
+
+// Runs the recipe for 'n' as a script with the interpreter 'interp' (a command
+// line, to which the path of the script is appended). Must be called with the
+// executor lock held, and releases it once the recipe has been printed.
+func (e *Executor) runInterp(n *node, interp []string, ruleName string, step int) (bool, error) {
+	dir := n.execDir()
+	if !n.rule.attrs.Quiet {
+		for _, cmd := range n.recipe {
+			e.printer.Print(cmd, dir, ruleName, step)
+		}
+	}
+	e.lock.Unlock()
+
+	if e.opts.NoExec {
+		return false, nil
+	}
+
+	script, err := os.CreateTemp("", "knit-script-")
+	if err != nil {
+		return true, fmt.Errorf("'%s': %w", ruleName, err)
+	}
+	defer os.Remove(script.Name())
+	_, err = script.WriteString(strings.Join(n.recipe, "\n") + "\n")
+	script.Close()
+	if err != nil {
+		return true, fmt.Errorf("'%s': %w", ruleName, err)
+	}
+
+	err = e.execCmd(command{
+		name:   interp[0],
+		args:   append(interp[1:len(interp):len(interp)], script.Name()),
+		recipe: strings.Join(n.recipe, "\n"),
+		dir:    dir,
+		env:    n.rule.opts.Env,
+		node:   n,
+		files:  []string{script.Name()},
+	})
+	if err != nil {
+		return e.opts.AbortOnError && !n.rule.attrs.NonStop, fmt.Errorf("'%s': error during recipe: %w", ruleName, err)
+	}
+	return false, nil
+}
+
+// Combines the commands of a recipe into a single shell script. Before each
+// command that begins a top-level shell statement, the script records the
+// command's index in the file 'status', so that a failure can be attributed
+// to the command that caused it. If 'errexit' is true, the script stops at the
+// first failing command.
+func oneShellScript(cmds []string, status string, errexit bool) string {
+	// line on which each command starts
+	starts := make(map[uint]int)
+	line := uint(1)
+	for i, c := range cmds {
+		starts[line] = i
+		line += uint(strings.Count(c, "\n")) + 1
+	}
+
+	// Only mark commands that start a top-level statement, and where no
+	// previous statement (such as a multi-line 'if' or a here-document)
+	// continues onto the same line.
+	marked := make(map[int]bool)
+	prog, err := syntax.NewParser().Parse(strings.NewReader(strings.Join(cmds, "\n")), "")
+	if err == nil {
+		var end uint
+		for _, stmt := range prog.Stmts {
+			l := stmt.Pos().Line()
+			if i, ok := starts[l]; ok && l > end {
+				marked[i] = true
+			}
+			syntax.Walk(stmt, func(node syntax.Node) bool {
+				if node != nil && node.End().Line() > end {
+					end = node.End().Line()
+				}
+				return true
+			})
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	if errexit {
+		buf.WriteString("set -e\n")
+	}
+	for i, c := range cmds {
+		if marked[i] {
+			fmt.Fprintf(buf, "echo %d > %s\n", i, shellquote.Join(status))
+		}
+		buf.WriteString(c)
+		buf.WriteByte('\n')
+	}
+	return buf.String()
+}
+
+func (e *Executor) getCmd(cmd string, n *node) (command, error) {
+	dir := n.execDir()
+	if n.rule.opts.Image != "" {
+		// the shell of the host may not exist in the image
+		return command{
+			name:   "sh",
+			args:   []string{"-c", cmd},
+			recipe: cmd,
+			dir:    dir,
+			env:    n.rule.opts.Env,
+			node:   n,
+		}, nil
+	}
 	if e.opts.Shell != "" {
 		return command{
 			name:   e.opts.Shell,
 			args:   []string{"-c", cmd},
 			recipe: cmd,
 			dir:    dir,
+			env:    n.rule.opts.Env,
+			node:   n,
 		}, nil
 	}
 	path, err := os.Executable()
@@ -284,44 +602,61 @@ func (e *Executor) getCmd(cmd string, dir string) (command, error) {
 		args:   []string{"--shrun", cmd},
 		recipe: cmd,
 		dir:    dir,
+		env:    n.rule.opts.Env,
+		node:   n,
 	}, nil
 }
 
 func (e *Executor) execCmd(c command) error {
 	// Save and reload DB when running a knit command from within knit
-	if len(c.args) >= 2 && strings.HasPrefix(c.args[1], "knit ") {
+	if len(c.args) >= 2 && invokesKnit(c.args[1]) {
 		e.db.Save()
 		defer e.db.Reload()
 	}
-	cmd := exec.Command(c.name, c.args...)
-	cmd.Dir = c.dir
-	cmd.Stdin = os.Stdin
-
-	if e.printer.NeedsUpdate() {
-		stdout, _ := cmd.StdoutPipe()
-		stderr, _ := cmd.StderrPipe()
-		err := cmd.Start()
-		if err != nil {
+	if c.node != nil && c.node.rule.opts.Image != "" {
+		var err error
+		if c, err = e.containerCmd(c); err != nil {
 			return err
 		}
-		go forwardStream(e.printer, stdout, os.Stdout)
-		go forwardStream(e.printer, stderr, os.Stderr)
-		return cmd.Wait()
 	}
-
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+	cmd := Command{
+		Name:   c.name,
+		Args:   c.args,
+		Dir:    c.dir,
+		Env:    c.env,
+		Stdin:  os.Stdin,
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}
+	if n := c.node; n != nil {
+		for _, p := range n.inputs() {
+			cmd.Inputs = append(cmd.Inputs, pathJoin(n.dir, p))
+		}
+		cmd.Inputs = append(cmd.Inputs, c.files...)
+		if !n.rule.attrs.Virtual {
+			for _, o := range n.outputs {
+				cmd.Outputs = append(cmd.Outputs, o.name)
+				if c.later {
+					cmd.Inputs = append(cmd.Inputs, o.name)
+				}
+			}
+		}
+	}
+	if e.printer.NeedsUpdate() {
+		cmd.Stdout = &printerWriter{p: e.printer, w: os.Stdout}
+		cmd.Stderr = &printerWriter{p: e.printer, w: os.Stderr}
+	}
+	return e.runner.Run(e.ctx, cmd)
 }
 
-func forwardStream(p Printer, stream io.Reader, w io.Writer) {
-	buf := make([]byte, 1024)
-	r := bufio.NewReader(stream)
-	for n, err := r.Read(buf); err == nil; n, err = r.Read(buf) {
-		p.Clear()
-		w.Write(buf[:n])
-		p.Update()
+// Returns true if any line of the shell command 'cmd' runs knit.
+func invokesKnit(cmd string) bool {
+	for _, line := range strings.Split(cmd, "\n") {
+		if strings.HasPrefix(line, "knit ") {
+			return true
+		}
 	}
+	return false
 }
 
 // Returns true if 'path' exists.
@@ -0,0 +1,285 @@
+package rules
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// A fakeVM expands '$var' references to the values of variables, and does not
+// support expressions.
+type fakeVM struct {
+	vars map[string]string
+}
+
+func (vm *fakeVM) ExpandFuncs() (func(string) (string, error), func(string) (string, error)) {
+	return func(name string) (string, error) {
+			v, ok := vm.vars[name]
+			if !ok {
+				return "", fmt.Errorf("undefined variable '%s'", name)
+			}
+			return v, nil
+		}, func(expr string) (string, error) {
+			return "", fmt.Errorf("cannot evaluate '%s'", expr)
+		}
+}
+
+func (vm *fakeVM) SetVar(name string, val interface{}) {
+	switch v := val.(type) {
+	case []string:
+		vm.vars[name] = strings.Join(v, " ")
+	default:
+		vm.vars[name] = fmt.Sprint(v)
+	}
+}
+
+// A fakeRunner records the commands that it runs instead of running them, and
+// fails the commands in 'fail'.
+type fakeRunner struct {
+	lock sync.Mutex
+	cmds []string
+	runs []Command
+	fail map[string]bool
+}
+
+func (r *fakeRunner) Run(ctx context.Context, cmd Command) error {
+	script := cmd.Args[len(cmd.Args)-1]
+	r.lock.Lock()
+	r.cmds = append(r.cmds, script)
+	r.runs = append(r.runs, cmd)
+	r.lock.Unlock()
+	if r.fail[script] {
+		return errors.New("exit status 1")
+	}
+	return nil
+}
+
+type nopPrinter struct{}
+
+func (nopPrinter) Print(cmd, dir string, name string, step int) {}
+func (nopPrinter) SetSteps(nsteps int)                          {}
+func (nopPrinter) Update()                                      {}
+func (nopPrinter) NeedsUpdate() bool                            { return false }
+func (nopPrinter) Done(name string)                             {}
+func (nopPrinter) Clear()                                       {}
+
+const testRules = `
+prog: a.o b.o
+	cc $input -o $output
+%.o: %.c
+	cc -c $input -o $output
+`
+
+// Builds 'target' from the rules in 'text', with the rule options 'ropts', in
+// a new directory containing a.c and b.c, which is the working directory until
+// the test ends. Commands are run by opts.Runner.
+func testBuild(t *testing.T, text, target string, ropts RuleOpts, opts Options) error {
+	dir := t.TempDir()
+	for _, f := range []string{"a.c", "b.c"} {
+		if err := os.WriteFile(filepath.Join(dir, f), []byte(f), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Chdir(dir)
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	rs := NewRuleSet(".")
+	if err := ParseInto(text, rs, "Knitfile", 1, ropts); err != nil {
+		t.Fatal(err)
+	}
+	g, err := NewGraph(rs, target, nil, GraphOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.ExpandRecipes(&fakeVM{vars: make(map[string]string)}); err != nil {
+		t.Fatal(err)
+	}
+	db := NewDatabase(filepath.Join(dir, ".knit"))
+	opts.Shell = "sh"
+	opts.AbortOnError = true
+	opts.Hash = true
+	e := NewExecutor(".", db, 1, nopPrinter{}, func(string) {}, opts)
+	_, err = e.Exec(g)
+	return err
+}
+
+func TestRunner(t *testing.T) {
+	r := &fakeRunner{}
+	if err := testBuild(t, testRules, "prog", RuleOpts{}, Options{Runner: r}); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"cc -c a.c -o a.o",
+		"cc -c b.c -o b.o",
+		"cc a.o b.o -o prog",
+	}
+	if !reflect.DeepEqual(r.cmds, expected) {
+		t.Errorf("expected commands %q, got %q", expected, r.cmds)
+	}
+}
+
+func TestRunnerFailure(t *testing.T) {
+	r := &fakeRunner{
+		fail: map[string]bool{"cc -c a.c -o a.o": true},
+	}
+	err := testBuild(t, testRules, "prog", RuleOpts{}, Options{Runner: r})
+	if err == nil || !strings.Contains(err.Error(), "'a.o': error during recipe") {
+		t.Errorf("expected the recipe for a.o to fail, got %v", err)
+	}
+	var lerr *LocationError
+	if !errors.As(err, &lerr) || !strings.HasPrefix(lerr.Location, "Knitfile:") {
+		t.Errorf("expected the error to be located in the Knitfile, got %v", err)
+	}
+	if strings.Count(err.Error(), "Knitfile:") != 1 {
+		t.Errorf("expected the location once, got %v", err)
+	}
+	for _, c := range r.cmds {
+		if strings.HasPrefix(c, "cc a.o") {
+			t.Errorf("prog was linked after a prereq failed")
+		}
+	}
+}
+
+func TestContainer(t *testing.T) {
+	r := &fakeRunner{}
+	err := testBuild(t, testRules, "a.o", RuleOpts{Image: "gcc:13"}, Options{Runner: r, Container: "podman"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.runs) != 1 {
+		t.Fatalf("expected 1 command, got %d", len(r.runs))
+	}
+	c := r.runs[0]
+	if c.Name != "podman" || len(c.Args) < 2 || c.Args[0] != "run" {
+		t.Fatalf("expected the recipe to run with 'podman run', got %s %q", c.Name, c.Args)
+	}
+	// the working directory must be mounted at the same path, and the
+	// prereq is inside it so it is not mounted separately
+	args := strings.Join(c.Args, " ")
+	var wd string
+	for i, a := range c.Args {
+		if a == "-w" && i+1 < len(c.Args) {
+			wd = c.Args[i+1]
+		}
+	}
+	if wd == "" || !strings.Contains(args, "-v "+wd+":"+wd+" ") {
+		t.Errorf("expected the working directory to be mounted, got %q", c.Args)
+	}
+	if strings.Contains(args, "a.c:") {
+		t.Errorf("expected a.c not to be mounted separately, got %q", c.Args)
+	}
+	if !strings.HasSuffix(args, " gcc:13 sh -c cc -c a.c -o a.o") {
+		t.Errorf("expected the recipe to run with sh in the image, got %q", c.Args)
+	}
+}
+
+// A fakeSSH runs the commands of an SSHRunner on the local machine: ssh
+// commands are run with sh, and rsync copies are done directly, with the
+// host removed from remote paths.
+type fakeSSH struct {
+	lock sync.Mutex
+	// number of commands run on each host
+	hosts map[string]int
+}
+
+func (f *fakeSSH) Run(ctx context.Context, c Command) error {
+	switch c.Name {
+	case "ssh":
+		host, script := c.Args[len(c.Args)-2], c.Args[len(c.Args)-1]
+		f.lock.Lock()
+		f.hosts[host]++
+		f.lock.Unlock()
+		return LocalRunner{}.Run(ctx, Command{
+			Name:   "sh",
+			Args:   []string{"-c", script},
+			Stdout: c.Stdout,
+			Stderr: c.Stderr,
+		})
+	case "rsync":
+		return fakeRsync(c.Args)
+	}
+	return fmt.Errorf("unexpected command %s", c.Name)
+}
+
+// Copies files like 'rsync -aR --ignore-missing-args -- srcs... dst'.
+func fakeRsync(args []string) error {
+	var i int
+	for i = range args {
+		if args[i] == "--" {
+			break
+		}
+	}
+	local := func(p string) string {
+		if j := strings.Index(p, ":"); j >= 0 {
+			return p[j+1:]
+		}
+		return p
+	}
+	srcs, dst := args[i+1:len(args)-1], local(args[len(args)-1])
+	for _, src := range srcs {
+		src = local(src)
+		// the part of the path after '/./' is recreated in the destination
+		rel := src
+		if j := strings.Index(src, "/./"); j >= 0 {
+			rel = src[j+len("/./"):]
+		}
+		err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			out := filepath.Join(dst, rel, strings.TrimPrefix(path, src))
+			if err := os.MkdirAll(filepath.Dir(out), os.ModePerm); err != nil {
+				return err
+			}
+			return os.WriteFile(out, data, info.Mode())
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+const workerRules = `
+prog: a.o b.o
+	cat $input > $output
+%.o: %.c
+	tr a-z A-Z < $input > $output
+`
+
+func TestWorkers(t *testing.T) {
+	f := &fakeSSH{hosts: make(map[string]int)}
+	r := NewSSHRunner([]Worker{
+		{Host: "w1", Jobs: 1, Dir: t.TempDir(), Sync: true},
+		{Host: "w2", Jobs: 2, Dir: t.TempDir(), Sync: true},
+	}, f)
+	if r.Jobs() != 3 {
+		t.Errorf("expected 3 jobs, got %d", r.Jobs())
+	}
+	if err := testBuild(t, workerRules, "prog", RuleOpts{}, Options{Runner: r}); err != nil {
+		t.Fatal(err)
+	}
+	// the workers' directories are separate from the build directory, so
+	// prog only exists if the outputs were copied back
+	data, err := os.ReadFile("prog")
+	if err != nil || string(data) != "A.CB.C" {
+		t.Errorf("unexpected contents of prog: %q (%v)", data, err)
+	}
+	if f.hosts["w1"] == 0 || f.hosts["w2"] == 0 {
+		t.Errorf("expected commands to run on both workers, got %v", f.hosts)
+	}
+}
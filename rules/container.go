@@ -0,0 +1,124 @@
+package rules
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Container runtimes that are used if none is given, in order of preference.
+var containerRuntimes = []string{"podman", "docker"}
+
+// Returns the container runtime that runs recipes with an image.
+func (e *Executor) containerRuntime() (string, error) {
+	if e.opts.Container != "" {
+		return e.opts.Container, nil
+	}
+	for _, rt := range containerRuntimes {
+		if _, err := exec.LookPath(rt); err == nil {
+			return rt, nil
+		}
+	}
+	return "", errors.New("no container runtime found (install podman or docker, or set one with --container)")
+}
+
+// Returns a command that runs 'c' in a new container from the image of its
+// node's rule. Paths are mounted at the same locations inside the container,
+// so the recipe works with the same paths as it would on the host, and the
+// outputs that it writes are stored directly on the host.
+func (e *Executor) containerCmd(c command) (command, error) {
+	rt, err := e.containerRuntime()
+	if err != nil {
+		return command{}, err
+	}
+	n := c.node
+	dir, err := filepath.Abs(c.dir)
+	if err != nil {
+		return command{}, err
+	}
+
+	args := []string{"run", "--rm", "-i"}
+	for _, m := range n.containerMounts(c.files) {
+		args = append(args, "-v", m)
+	}
+	args = append(args, "-w", dir)
+	for _, env := range c.env {
+		args = append(args, "-e", env)
+	}
+	// Docker runs commands as root by default, which would leave outputs
+	// that the user cannot modify. Rootless Podman already maps root in the
+	// container to the user.
+	if filepath.Base(rt) == "docker" && os.Getuid() >= 0 {
+		args = append(args, "--user", strconv.Itoa(os.Getuid())+":"+strconv.Itoa(os.Getgid()))
+	}
+	args = append(args, n.rule.opts.Image, c.name)
+	args = append(args, c.args...)
+
+	c.name = rt
+	c.args = args
+	c.env = nil
+	return c, nil
+}
+
+// Returns the volumes, in the form 'path:path[:ro]', to mount in a container
+// that runs this node's recipe. The rule's directory, the directories of its
+// outputs, and 'files' are writable, and its prereqs outside of them are
+// read-only.
+func (n *node) containerMounts(files []string) []string {
+	var dirs, ro, rwfiles []string
+	abs := func(path string) string {
+		p, err := filepath.Abs(path)
+		if err != nil {
+			return filepath.Clean(path)
+		}
+		return p
+	}
+	dirs = append(dirs, abs(n.dir), abs(n.execDir()))
+	for _, o := range n.outputs {
+		dirs = append(dirs, abs(filepath.Dir(o.name)))
+	}
+	for _, p := range n.myPrereqs {
+		ro = append(ro, abs(filepath.Join(n.dir, p)))
+	}
+	for _, f := range files {
+		rwfiles = append(rwfiles, abs(f))
+	}
+
+	// mount each directory once, and only if it isn't already inside a
+	// mounted directory
+	sort.Strings(dirs)
+	var mounts, rw []string
+	for _, d := range dirs {
+		if !within(d, rw) && exists(d) {
+			rw = append(rw, d)
+			mounts = append(mounts, d+":"+d)
+		}
+	}
+	for _, f := range rwfiles {
+		if !within(f, rw) && exists(f) {
+			mounts = append(mounts, f+":"+f)
+			rw = append(rw, f)
+		}
+	}
+	sort.Strings(ro)
+	for i, f := range ro {
+		if (i == 0 || f != ro[i-1]) && !within(f, rw) && exists(f) {
+			mounts = append(mounts, f+":"+f+":ro")
+		}
+	}
+	return mounts
+}
+
+// Returns true if 'path' is one of 'dirs' or is inside one of them.
+func within(path string, dirs []string) bool {
+	for _, d := range dirs {
+		if path == d || strings.HasPrefix(path, d+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
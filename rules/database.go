@@ -30,24 +30,82 @@ func hashSliceAndString(s []string, str string) uint64 {
 	return fnv1a.HashString64(strings.Join(s, "") + str)
 }
 
-func modifiedTime(path string) time.Time {
-	var mtime time.Time
-	filepath.WalkDir(path, func(path string, info fs.DirEntry, err error) error {
-		if !info.IsDir() {
-			info, _ := info.Info()
-			ftime := info.ModTime()
-			if ftime.After(mtime) {
-				mtime = ftime
+func skipped(patterns []string, rel, name string) bool {
+	for _, pat := range patterns {
+		if ok, _ := filepath.Match(pat, rel); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(pat, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Calls 'fn' for every file (that is not a directory) in the tree rooted at
+// 'root', which may also be a single file. Files and directories that match
+// any of the glob patterns in 'skip' are ignored. Patterns are matched against
+// paths relative to 'root', and against file names.
+func walkTree(root string, skip []string, fn func(path string, d fs.DirEntry)) {
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if len(skip) != 0 && path != root {
+			rel, _ := filepath.Rel(root, path)
+			if skipped(skip, rel, d.Name()) {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
 			}
 		}
+		if !d.IsDir() {
+			fn(path, d)
+		}
 		return nil
 	})
+}
+
+func modifiedTime(path string, skip []string) time.Time {
+	var mtime time.Time
+	walkTree(path, skip, func(path string, d fs.DirEntry) {
+		info, err := d.Info()
+		if err != nil {
+			return
+		}
+		if ftime := info.ModTime(); ftime.After(mtime) {
+			mtime = ftime
+		}
+	})
 	return mtime
 }
 
-func hashFile(path string) uint64 {
-	mtime := modifiedTime(path)
-	cached, hit := hashCache[path]
+// Returns the current time of the clock that the filesystem uses for
+// modification times, which may lag behind time.Now.
+func fsNow() time.Time {
+	f, err := os.CreateTemp("", "knit-clock")
+	if err != nil {
+		return time.Now()
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return time.Now()
+	}
+	return info.ModTime()
+}
+
+// Returns the hash of the file or directory at 'path', ignoring the files in a
+// directory that match the patterns in 'skip'.
+func hashFile(path string, skip []string) uint64 {
+	mtime := modifiedTime(path, skip)
+	key := path
+	if len(skip) != 0 {
+		key += "\x00" + strings.Join(skip, " ")
+	}
+	cached, hit := hashCache[key]
 	if hit {
 		if mtime == cached.mtime {
 			log.Println("using cached hash for", path)
@@ -56,15 +114,12 @@ func hashFile(path string) uint64 {
 	}
 	log.Println("computing hash for", path)
 	var hash uint64
-	filepath.WalkDir(path, func(path string, info fs.DirEntry, err error) error {
-		if !info.IsDir() {
-			data, _ := os.ReadFile(path)
-			hash = fnv1a.AddBytes64(hash, data)
-			hash = fnv1a.AddString64(hash, path)
-		}
-		return nil
+	walkTree(path, skip, func(path string, d fs.DirEntry) {
+		data, _ := os.ReadFile(path)
+		hash = fnv1a.AddBytes64(hash, data)
+		hash = fnv1a.AddString64(hash, path)
 	})
-	hashCache[path] = memoizedHash{
+	hashCache[key] = memoizedHash{
 		hash,
 		mtime,
 	}
@@ -97,6 +152,9 @@ func NewDatabase(dir string) *Database {
 	if d.OutputDirs == nil {
 		d.OutputDirs = make(map[string]bool)
 	}
+	if d.Trees == nil {
+		d.Trees = make(map[string]time.Time)
+	}
 
 	return &Database{
 		location: dir,
@@ -129,6 +187,19 @@ type data struct {
 	Prereqs    Prereqs
 	Outputs    map[string]bool
 	OutputDirs map[string]bool
+	// map from directory targets to the time at which they were last built
+	// (by the filesystem's clock)
+	Trees map[string]time.Time
+	// map from hash of a configuration check (and the environment it was
+	// run in) to its result
+	Probes map[uint64]ProbeResult
+}
+
+// A ProbeResult is the memoized result of a configuration check performed by
+// a Knitfile, such as checking whether a header is available.
+type ProbeResult struct {
+	OK  bool
+	Out []string
 }
 
 func newData() *data {
@@ -141,6 +212,8 @@ func newData() *data {
 		},
 		Outputs:    make(map[string]bool),
 		OutputDirs: make(map[string]bool),
+		Trees:      make(map[string]time.Time),
+		Probes:     make(map[uint64]ProbeResult),
 	}
 }
 
@@ -152,6 +225,36 @@ func (d *data) AddOutputDir(dir string) {
 	d.OutputDirs[dir] = true
 }
 
+// Records that 'dir' is a directory target, keeping the time at which it was
+// last built if it has one.
+func (d *data) AddTree(dir string) {
+	if _, ok := d.Trees[dir]; !ok {
+		d.Trees[dir] = time.Time{}
+	}
+}
+
+// Records that the directory target 'dir' was last built at time 't'.
+func (d *data) SetTreeTime(dir string, t time.Time) {
+	d.Trees[dir] = t
+}
+
+// Returns the hash of a configuration check described by 'key'.
+func probeHash(key []string) uint64 {
+	return fnv1a.HashString64(strings.Join(key, "\x00"))
+}
+
+// Probe returns the stored result of the configuration check described by
+// 'key', if there is one.
+func (d *data) Probe(key []string) (ProbeResult, bool) {
+	r, ok := d.Probes[probeHash(key)]
+	return r, ok
+}
+
+// SetProbe stores the result of the configuration check described by 'key'.
+func (d *data) SetProbe(key []string, r ProbeResult) {
+	d.Probes[probeHash(key)] = r
+}
+
 func (d *data) WriteBytesTo(w io.Writer) error {
 	fz := gzip.NewWriter(w)
 	enc := gob.NewEncoder(fz)
@@ -176,6 +279,9 @@ func loadData(d io.Reader) (*data, error) {
 	if dat.Prereqs.Hashes == nil {
 		dat.Prereqs.Hashes = make(map[uint64]*Files)
 	}
+	if dat.Probes == nil {
+		dat.Probes = make(map[uint64]ProbeResult)
+	}
 
 	return &dat, err
 }
@@ -214,7 +320,7 @@ type Prereqs struct {
 	Hashes map[uint64]*Files
 }
 
-func (p *Prereqs) insert(targets []string, prereq, dir string) {
+func (p *Prereqs) insert(targets []string, prereq string, skip []string, dir string) {
 	thash := hashSliceAndString(targets, dir)
 	f := p.Hashes[thash]
 	if f == nil {
@@ -222,16 +328,16 @@ func (p *Prereqs) insert(targets []string, prereq, dir string) {
 			Data: make(map[string]File),
 		}
 	}
-	p.Hashes[thash].insert(prereq)
+	p.Hashes[thash].insert(prereq, skip)
 }
 
-func (p *Prereqs) has(targets []string, prereq, dir string) int {
+func (p *Prereqs) has(targets []string, prereq string, skip []string, dir string) int {
 	thash := hashSliceAndString(targets, dir)
 	files, ok := p.Hashes[thash]
 	if !ok {
 		return noTargets
 	}
-	if files.matches(prereq) {
+	if files.matches(prereq, skip) {
 		return hasAll
 	}
 	return noHash
@@ -242,7 +348,7 @@ type Files struct {
 	Data map[string]File
 }
 
-func (f *Files) insert(path string) {
+func (f *Files) insert(path string, skip []string) {
 	if file, ok := f.Data[path]; ok {
 		// Check if file in database needs to be updated (rehashed): it
 		// doesn't if it hasn't been modified.
@@ -251,12 +357,12 @@ func (f *Files) insert(path string) {
 			return
 		}
 	}
-	f.Data[path] = NewFile(path)
+	f.Data[path] = NewFile(path, skip)
 }
 
-func (f *Files) matches(path string) bool {
+func (f *Files) matches(path string, skip []string) bool {
 	if file, ok := f.Data[path]; ok {
-		return file.Equals(path)
+		return file.Equals(path, skip)
 	}
 	return false
 }
@@ -270,7 +376,9 @@ type File struct {
 	Exists bool
 }
 
-func NewFile(path string) File {
+// NewFile returns the file at 'path', ignoring the files that match the
+// patterns in 'skip' if it is a directory.
+func NewFile(path string, skip []string) File {
 	info, err := os.Stat(path)
 	if err != nil {
 		return File{
@@ -282,13 +390,13 @@ func NewFile(path string) File {
 	return File{
 		ModTime: info.ModTime(),
 		Size:    info.Size(),
-		Full:    hashFile(path),
+		Full:    hashFile(path, skip),
 		Path:    path,
 		Exists:  true,
 	}
 }
 
-func (f File) Equals(path string) bool {
+func (f File) Equals(path string, skip []string) bool {
 	if f.Path != path {
 		return false
 	}
@@ -305,5 +413,5 @@ func (f File) Equals(path string) bool {
 	if info.Size() != f.Size {
 		return false
 	}
-	return hashFile(path) == f.Full
+	return hashFile(path, skip) == f.Full
 }
@@ -1,6 +1,7 @@
 package rules
 
 import (
+	"errors"
 	"fmt"
 	"io/fs"
 	"log"
@@ -23,6 +24,18 @@ type Graph struct {
 
 	rules *RuleSet
 
+	// meta-rules (by index) that were used to build a target
+	metaUsed map[int]bool
+
+	opts    GraphOptions
+	updated map[string]bool
+	// VM used to expand recipes, for nodes added during the build
+	vm VM
+
+	// ambiguities that have already been reported
+	ambiguities map[string]bool
+	ambErr      error
+
 	// timestamp cache
 	tscache map[string]time.Time
 }
@@ -63,6 +76,84 @@ type info struct {
 	meta    bool
 	match   string
 	matches []string
+	pattern string // pattern of the meta-rule that provides the recipe
+}
+
+// Returns the directory that this node's recipe should be executed in.
+func (n *node) execDir() string {
+	if n.rule.opts.Dir == "" {
+		return n.dir
+	}
+	return pathJoin(n.dir, n.rule.opts.Dir)
+}
+
+// Returns the command line of the interpreter that should run this node's
+// recipe as a script, or nil if the recipe should be run by the shell. The
+// interpreter is given by the X attribute, or by a '#!' line at the start of
+// the recipe, and in both cases is split into arguments at whitespace.
+func (n *node) interpreter() []string {
+	if interp := strings.Fields(n.rule.attrs.Interp); len(interp) > 0 {
+		return interp
+	}
+	if len(n.recipe) > 0 && strings.HasPrefix(n.recipe[0], "#!") {
+		if interp := strings.Fields(n.recipe[0][len("#!"):]); len(interp) > 0 {
+			return interp
+		}
+	}
+	return nil
+}
+
+// Returns the expanded recipe, along with the rule options that affect how
+// it is executed. Used to determine if the recipe has changed since the last
+// build.
+func (n *node) recipeKey() []string {
+	attrs := n.rule.attrs
+	if len(n.rule.opts.Env) == 0 && n.rule.opts.Dir == "" && n.rule.opts.Func == nil && n.rule.opts.Image == "" && attrs.Interp == "" && !attrs.OneShell {
+		return n.recipe
+	}
+	key := make([]string, 0, len(n.recipe)+len(n.rule.opts.Env)+1)
+	key = append(key, n.recipe...)
+	if attrs.Interp != "" {
+		key = append(key, "\x00interp:"+attrs.Interp)
+	}
+	if attrs.OneShell {
+		key = append(key, "\x00oneshell")
+	}
+	for _, e := range n.rule.opts.Env {
+		key = append(key, "\x00env:"+e)
+	}
+	if n.rule.opts.Dir != "" {
+		key = append(key, "\x00dir:"+n.rule.opts.Dir)
+	}
+	if n.rule.opts.Func != nil {
+		key = append(key, "\x00func:"+n.rule.opts.Func.Key)
+	}
+	if n.rule.opts.Image != "" {
+		key = append(key, "\x00image:"+n.rule.opts.Image)
+	}
+	return key
+}
+
+// Returns the context passed to this node's recipe function.
+func (n *node) recipeContext() RecipeContext {
+	join := func(paths []string) []string {
+		joined := make([]string, 0, len(paths))
+		for _, p := range paths {
+			joined = append(joined, pathJoin(n.dir, p))
+		}
+		return joined
+	}
+	ctx := RecipeContext{
+		Dir:     n.dir,
+		Inputs:  join(n.myExpPrereqs),
+		Outputs: join(n.rule.targets),
+		Match:   n.match,
+		Matches: n.matches,
+	}
+	if n.rule.attrs.Dep != "" {
+		ctx.Dep = pathJoin(n.dir, n.rule.attrs.Dep)
+	}
+	return ctx
 }
 
 // Wait until this node's condition variable is signaled.
@@ -93,21 +184,26 @@ func (n *node) setDone(db *Database, noexec, hash bool) bool {
 			for _, p := range n.prereqs {
 				for _, f := range p.outputs {
 					// TODO: think about path normalization?
-					db.Prereqs.insert(n.rule.targets, f.name, n.dir)
+					db.Prereqs.insert(n.rule.targets, f.name, f.skip, n.dir)
 				}
 			}
 			if n.rule.attrs.Dep != "" {
 				prereqs := loadDeps(n.dir, nil, n.rule.attrs.Dep, n.myTarget, n.optional)
 				for _, p := range prereqs {
 					path := relify(p.name)
-					db.Prereqs.insert(n.rule.targets, path, n.dir)
+					db.Prereqs.insert(n.rule.targets, path, nil, n.dir)
 				}
 			}
 		}
 		// TODO: think about path normalization?
-		db.Recipes.insert(n.rule.targets, n.recipe, n.dir)
+		db.Recipes.insert(n.rule.targets, n.recipeKey(), n.dir)
 		for _, f := range n.outputs {
-			if len(n.recipe) != 0 {
+			if len(n.recipe) == 0 {
+				continue
+			}
+			if n.rule.attrs.Tree {
+				db.AddTree(f.name)
+			} else {
 				db.AddOutput(f.name)
 			}
 		}
@@ -122,11 +218,14 @@ type file struct {
 	t       time.Time
 	exists  bool
 	updated bool
+	// glob patterns for the files that are ignored if this is a directory
+	skip []string
 }
 
-func newFile(target string, updated map[string]bool, tscache map[string]time.Time) *file {
+func newFile(target string, skip []string, updated map[string]bool, tscache map[string]time.Time) *file {
 	f := &file{
 		name: target,
+		skip: skip,
 	}
 	f.updated = updated[f.name]
 	f.updateTimestamp(tscache)
@@ -141,18 +240,22 @@ func pathJoin(dir, target string) string {
 	return p
 }
 
-func dirTime(dir string, mintime time.Time) time.Time {
-	filepath.WalkDir(dir, func(path string, info fs.DirEntry, err error) error {
-		if !info.IsDir() {
-			finfo, err := os.Stat(path)
-			if err == nil {
-				t := finfo.ModTime()
-				if t.After(mintime) {
-					mintime = t
-				}
+// Returns the latest modification time of the files in 'dir' that are not
+// ignored, and of 'dir' itself if no files are ignored (since creating or
+// removing an ignored file also modifies 'dir').
+func dirTime(dir string, skip []string, dirtime time.Time) time.Time {
+	var mintime time.Time
+	if len(skip) == 0 {
+		mintime = dirtime
+	}
+	walkTree(dir, skip, func(path string, d fs.DirEntry) {
+		finfo, err := os.Stat(path)
+		if err == nil {
+			t := finfo.ModTime()
+			if t.After(mintime) {
+				mintime = t
 			}
 		}
-		return nil
 	})
 
 	return mintime
@@ -168,7 +271,7 @@ func (f *file) updateTimestamp(timestamps map[string]time.Time) {
 	info, err := os.Stat(f.name)
 	if err == nil {
 		if info.IsDir() {
-			f.t = dirTime(f.name, info.ModTime())
+			f.t = dirTime(f.name, f.skip, info.ModTime())
 		} else {
 			f.t = info.ModTime()
 		}
@@ -187,7 +290,7 @@ func (g *Graph) newNode(target string, updated map[string]bool) *node {
 	n := &node{
 		info: &info{
 			outputs: map[string]*file{
-				target: newFile(target, updated, g.tscache),
+				target: newFile(target, nil, updated, g.tscache),
 			},
 			cond:     sync.NewCond(&sync.Mutex{}),
 			optional: make(map[int]bool),
@@ -200,21 +303,91 @@ func (g *Graph) Size() int {
 	return len(g.nodes)
 }
 
-func NewGraph(rs *RuleSet, target string, updated map[string]bool) (g *Graph, err error) {
+// Ambiguity determines what happens when a target can be built by more than
+// one rule with a recipe.
+type Ambiguity int
+
+const (
+	AmbiguityIgnore Ambiguity = iota // use the last rule defined
+	AmbiguityWarn                    // use the last rule defined and warn
+	AmbiguityError                   // fail to create the graph
+)
+
+// ParseAmbiguity converts a mode name (ignore, warn, or error) into an
+// Ambiguity. The empty string is the same as ignore.
+func ParseAmbiguity(s string) (Ambiguity, error) {
+	switch s {
+	case "", "ignore":
+		return AmbiguityIgnore, nil
+	case "warn":
+		return AmbiguityWarn, nil
+	case "error":
+		return AmbiguityError, nil
+	}
+	return AmbiguityIgnore, fmt.Errorf("invalid ambiguity mode: %s (must be ignore, warn, or error)", s)
+}
+
+type GraphOptions struct {
+	Ambiguity Ambiguity        // how to handle ambiguous rules
+	Warn      func(msg string) // called with warnings (if nil, they are logged)
+}
+
+func NewGraph(rs *RuleSet, target string, updated map[string]bool, opts GraphOptions) (g *Graph, err error) {
 	g = &Graph{
-		nodes:     make(map[string]*node),
-		fullNodes: make(map[string]*node),
-		rules:     rs,
-		tscache:   make(map[string]time.Time),
+		nodes:       make(map[string]*node),
+		fullNodes:   make(map[string]*node),
+		rules:       rs,
+		metaUsed:    make(map[int]bool),
+		opts:        opts,
+		updated:     updated,
+		ambiguities: make(map[string]bool),
+		tscache:     make(map[string]time.Time),
 	}
 	visits := make([]int, len(rs.metaRules))
 	g.base, err = g.resolveTarget(prereq{name: target}, visits, updated)
+	if g.ambErr != nil {
+		return g, g.ambErr
+	}
+	var nerr *NoRuleError
+	if errors.As(err, &nerr) && nerr.suggest == nil {
+		// suggestions are only found if the error is shown to the user,
+		// and from the directory of the rules even if it has changed by
+		// then
+		dir, derr := os.Getwd()
+		if derr != nil {
+			dir = "."
+		}
+		target := nerr.Target
+		nerr.suggest = func() []string {
+			return rs.suggestIn(dir, target)
+		}
+	}
 	if err != nil {
 		return g, err
 	}
 	return g, checkCycles(g.base)
 }
 
+// Reports an ambiguity described by 'msg' according to the ambiguity mode.
+// In error mode, the first ambiguity is returned by NewGraph even if the
+// target could be resolved, since it is usually the cause of other errors.
+func (g *Graph) ambiguous(msg string) {
+	if g.ambiguities[msg] {
+		return
+	}
+	g.ambiguities[msg] = true
+	switch {
+	case g.opts.Ambiguity == AmbiguityError:
+		if g.ambErr == nil {
+			g.ambErr = errors.New(msg)
+		}
+	case g.opts.Warn != nil:
+		g.opts.Warn("warning: " + msg)
+	default:
+		log.Println("warning: " + msg)
+	}
+}
+
 func rel(basepath, targpath string) (string, error) {
 	if filepath.IsAbs(targpath) {
 		return targpath, nil
@@ -244,7 +417,7 @@ func (g *Graph) resolveTarget(target prereq, visits []int, updated map[string]bo
 			return nil, err
 		}
 		if _, ok := n.outputs[reltarget]; !ok && !n.rule.attrs.Virtual {
-			n.outputs[reltarget] = newFile(fulltarget, updated, g.tscache)
+			n.outputs[reltarget] = newFile(fulltarget, nil, updated, g.tscache)
 		}
 		return n, nil
 	}
@@ -255,12 +428,17 @@ func (g *Graph) resolveTarget(target prereq, visits []int, updated map[string]bo
 	ris, ok := g.rules.targets[fulltarget]
 	if ok && len(ris) > 0 {
 		var prereqs []prereq
+		var full *DirectRule
 		// Go through all the rules and accumulate all the prereqs. If multiple
 		// rules have targets then we have some ambiguity, but we select the
 		// last one.
 		for _, ri := range ris {
 			r := &g.rules.directRules[ri]
 			if len(r.recipe) != 0 {
+				if full != nil && g.opts.Ambiguity != AmbiguityIgnore && full.location() != r.location() {
+					g.ambiguous(fmt.Sprintf("rules at %s and %s both build '%s'", full.location(), r.location(), fulltarget))
+				}
+				full = r
 				// recipe exists -- overwrite prereqs
 				prereqs = r.prereqs
 				expprereqs = prereqsStr(r.prereqs, true)
@@ -291,6 +469,7 @@ func (g *Graph) resolveTarget(target prereq, visits []int, updated map[string]bo
 		// then can skip subsequent full rules (with recipes), and add
 		// subsequent prereq rules (rules without recipes).
 		var curtarg string
+		var chosen *MetaRule // meta-rule that provides the recipe
 		best := rule
 		for mi := len(g.rules.metaRules) - 1; mi >= 0; mi-- {
 			mr := g.rules.metaRules[mi]
@@ -310,6 +489,12 @@ func (g *Graph) resolveTarget(target prereq, visits []int, updated map[string]bo
 				}
 				// if this rule has a recipe and we already have a recipe, skip it
 				if curtarg != "" && len(curtarg) <= len(reltarget) && len(mr.recipe) > 0 && len(best.recipe) > 0 {
+					// rules in the same directory are ambiguous if the
+					// skipped rule could have been used instead
+					if g.opts.Ambiguity != AmbiguityIgnore && len(curtarg) == len(reltarget) &&
+						g.canResolve(mi, mr.dir, metaPrereqs(&mr, pat, sub, reltarget), visits, updated) {
+						g.ambiguous(fmt.Sprintf("meta-rules at %s and %s both match '%s'", mr.location(), chosen.location(), fulltarget))
+					}
 					continue
 				}
 
@@ -317,46 +502,32 @@ func (g *Graph) resolveTarget(target prereq, visits []int, updated map[string]bo
 				metarule.attrs = mr.attrs
 				metarule.recipe = mr.recipe
 				metarule.dir = mr.dir
+				metarule.opts = mr.opts
+				metarule.file = mr.file
+				metarule.line = mr.line
 
+				metarule.prereqs = metaPrereqs(&mr, pat, sub, reltarget)
 				// there should be exactly 1 submatch (2 indices for full
 				// match, 2 for the submatch) for a % match.
 				if pat.Suffix && len(sub) == 4 {
 					// %-metarule -- the match is the submatch and all %s in the
 					// prereqs get expanded to the submatch
 					n.match = string(reltarget[sub[2]:sub[3]])
-					for _, p := range mr.prereqs {
-						p.name = strings.ReplaceAll(p.name, "%", n.match)
-						metarule.prereqs = append(metarule.prereqs, p)
-					}
 					metarule.attrs.Dep = strings.ReplaceAll(metarule.attrs.Dep, "%", n.match)
+					metarule.attrs.Dyndep = strings.ReplaceAll(metarule.attrs.Dyndep, "%", n.match)
 				} else {
-					// regex match, accumulate all the matches and expand them in the prereqs
+					// regex match, accumulate all the matches
 					for i := 0; i < len(sub); i += 2 {
 						n.matches = append(n.matches, string(reltarget[sub[i]:sub[i+1]]))
 					}
-					for _, p := range mr.prereqs {
-						expanded := pat.Regex.ExpandString([]byte{}, p.name, reltarget, sub)
-						metarule.prereqs = append(metarule.prereqs, prereq{name: string(expanded), attrs: p.attrs})
-					}
 					expanded := pat.Regex.ExpandString([]byte{}, rule.attrs.Dep, reltarget, sub)
 					metarule.attrs.Dep = string(expanded)
+					expanded = pat.Regex.ExpandString([]byte{}, mr.attrs.Dyndep, reltarget, sub)
+					metarule.attrs.Dyndep = string(expanded)
 				}
 
 				// Only use this rule if its prereqs can also be resolved.
-				failed := false
-				visits[mi]++
-				// Is there significant performance impact from this?
-				for _, p := range metarule.prereqs {
-					_, err := g.resolveTarget(prereq{attrs: p.attrs, name: pathJoin(metarule.dir, p.name)}, visits, updated)
-					if err != nil {
-						log.Printf("could not use metarule '%s': %s\n", mr.String(), err)
-						failed = true
-						break
-					}
-				}
-				visits[mi]--
-
-				if failed {
+				if !g.canResolve(mi, metarule.dir, metarule.prereqs, visits, updated) {
 					continue
 				}
 
@@ -369,7 +540,12 @@ func (g *Graph) resolveTarget(target prereq, visits []int, updated map[string]bo
 					best.prereqs = append(rule.prereqs, metarule.prereqs...)
 					best.attrs = metarule.attrs
 					best.recipe = metarule.recipe
+					best.opts = metarule.opts
+					best.file = metarule.file
+					best.line = metarule.line
 					best.targets = []string{reltarget}
+					chosen = &g.rules.metaRules[mi]
+					n.pattern = pat.Source
 				} else {
 					best.prereqs = append(best.prereqs, metarule.prereqs...)
 				}
@@ -377,6 +553,7 @@ func (g *Graph) resolveTarget(target prereq, visits []int, updated map[string]bo
 
 				n.meta = true
 				ri = mi // for visit tracking
+				g.metaUsed[mi] = true
 			}
 		}
 		rule = best
@@ -389,7 +566,21 @@ func (g *Graph) resolveTarget(target prereq, visits []int, updated map[string]bo
 	if rule.attrs.Dep != "" {
 		dep := pathJoin(rule.dir, rule.attrs.Dep)
 		rule.prereqs = loadDeps(n.dir, rule.prereqs, dep, fulltarget, n.optional)
-		n.outputs[dep] = newFile(pathJoin(n.dir, rule.attrs.Dep), updated, g.tscache)
+		n.outputs[dep] = newFile(pathJoin(n.dir, rule.attrs.Dep), nil, updated, g.tscache)
+	}
+
+	if rule.attrs.Dyndep != "" {
+		// the dyndep file must be built before this rule, and the
+		// dependencies it listed in the previous build are used until it is
+		// reloaded
+		dyndep := pathJoin(rule.dir, rule.attrs.Dyndep)
+		if !hasPrereq(rule.prereqs, rule.attrs.Dyndep) {
+			rule.prereqs = append(rule.prereqs[:len(rule.prereqs):len(rule.prereqs)], prereq{
+				name:  rule.attrs.Dyndep,
+				attrs: AttrSet{Implicit: true},
+			})
+		}
+		rule.prereqs = loadDeps(n.dir, rule.prereqs, dyndep, fulltarget, n.optional)
 	}
 
 	if rule.attrs.Virtual {
@@ -399,7 +590,7 @@ func (g *Graph) resolveTarget(target prereq, visits []int, updated map[string]bo
 	if len(rule.targets) == 0 && !rule.attrs.Virtual {
 		for o, f := range n.outputs {
 			if !f.exists {
-				return nil, fmt.Errorf("no rule to knit target '%s'", o)
+				return nil, &NoRuleError{Target: o}
 			}
 		}
 		// If this rule had no targets, the target is the requested one. For
@@ -411,6 +602,11 @@ func (g *Graph) resolveTarget(target prereq, visits []int, updated map[string]bo
 	n.myPrereqs = prereqsStr(rule.prereqs, false)
 	n.myExpPrereqs = expprereqs
 
+	var skip []string
+	if rule.attrs.Tree {
+		skip = strings.Fields(rule.attrs.TreeSkip)
+	}
+
 	// if the rule we found is equivalent to an existing rule that also builds
 	// this target, then use that
 	if gn, ok := g.fullNodes[fulltarget]; ok && gn.rule.Equals(&rule) {
@@ -420,12 +616,12 @@ func (g *Graph) resolveTarget(target prereq, visits []int, updated map[string]bo
 			return nil, err
 		}
 		if _, ok := n.outputs[reltarget]; !ok && !rule.attrs.Virtual {
-			n.outputs[reltarget] = newFile(fulltarget, updated, g.tscache)
+			n.outputs[reltarget] = newFile(fulltarget, skip, updated, g.tscache)
 		}
 		n.info = gn.info
 		n.myTarget = reltarget
 		if !rule.attrs.Virtual {
-			n.myOutput = newFile(fulltarget, updated, g.tscache)
+			n.myOutput = newFile(fulltarget, skip, updated, g.tscache)
 		}
 		g.nodes[fulltarget] = n
 		return n, nil
@@ -438,16 +634,23 @@ func (g *Graph) resolveTarget(target prereq, visits []int, updated map[string]bo
 		return nil, err
 	}
 
+	if len(skip) != 0 {
+		for _, t := range n.rule.targets {
+			// the timestamp may have been computed without skipping files
+			delete(g.tscache, pathJoin(n.dir, t))
+		}
+	}
+
 	for _, t := range n.rule.targets {
 		if !n.rule.attrs.Virtual {
-			n.outputs[t] = newFile(pathJoin(n.dir, t), updated, g.tscache)
+			n.outputs[t] = newFile(pathJoin(n.dir, t), skip, updated, g.tscache)
 		}
 		g.fullNodes[pathJoin(n.dir, t)] = n
 	}
 
 	n.myTarget = reltarget
 	if !n.rule.attrs.Virtual {
-		n.myOutput = newFile(fulltarget, updated, g.tscache)
+		n.myOutput = newFile(fulltarget, skip, updated, g.tscache)
 	}
 
 	// associate this node with only the requested target
@@ -462,6 +665,11 @@ func (g *Graph) resolveTarget(target prereq, visits []int, updated map[string]bo
 			if n.optional[i] {
 				continue
 			}
+			var nerr *NoRuleError
+			if errors.As(err, &nerr) && nerr.Rule == "" && n.rule.file != "" {
+				nerr.Rule = reltarget
+				nerr.Location = n.rule.location()
+			}
 			// there was an error with a prereq, so this node is invalid and we
 			// must remove it from the maps
 			delete(g.nodes, fulltarget)
@@ -479,13 +687,115 @@ func (g *Graph) resolveTarget(target prereq, visits []int, updated map[string]bo
 	return n, nil
 }
 
+// Returns the prereqs of the meta-rule 'mr' when it is used to build
+// 'reltarget', given the submatch indices from matching 'pat'.
+func metaPrereqs(mr *MetaRule, pat *Pattern, sub []int, reltarget string) []prereq {
+	prereqs := make([]prereq, 0, len(mr.prereqs))
+	if pat.Suffix && len(sub) == 4 {
+		// %-metarule -- all %s in the prereqs get expanded to the submatch
+		match := reltarget[sub[2]:sub[3]]
+		for _, p := range mr.prereqs {
+			p.name = strings.ReplaceAll(p.name, "%", match)
+			prereqs = append(prereqs, p)
+		}
+		return prereqs
+	}
+	// regex match, expand the matches in the prereqs
+	for _, p := range mr.prereqs {
+		expanded := pat.Regex.ExpandString([]byte{}, p.name, reltarget, sub)
+		prereqs = append(prereqs, prereq{name: string(expanded), attrs: p.attrs})
+	}
+	return prereqs
+}
+
+// Returns true if all the prereqs of an instance of the meta-rule at index
+// 'mi' (with directory 'dir') can be resolved.
+func (g *Graph) canResolve(mi int, dir string, prereqs []prereq, visits []int, updated map[string]bool) bool {
+	visits[mi]++
+	defer func() { visits[mi]-- }()
+	// Is there significant performance impact from this?
+	for _, p := range prereqs {
+		_, err := g.resolveTarget(prereq{attrs: p.attrs, name: pathJoin(dir, p.name)}, visits, updated)
+		if err != nil {
+			log.Printf("could not use metarule '%s': %s\n", g.rules.metaRules[mi].String(), err)
+			return false
+		}
+	}
+	return true
+}
+
+// A NoRuleError is returned when there is no way to build a target.
+type NoRuleError struct {
+	Target string
+	// target of the rule that requires Target, and the location where that
+	// rule was defined, if known
+	Rule     string
+	Location string
+
+	// finds the suggestions, if the error is from NewGraph, and the
+	// suggestions once they have been found
+	suggest     func() []string
+	suggestions []string
+}
+
+// Suggestions returns the targets that may have been meant instead of Target.
+// Finding them may require looking at many files, so they are only found the
+// first time they are needed.
+func (e *NoRuleError) Suggestions() []string {
+	if e.suggest != nil {
+		e.suggestions = e.suggest()
+		e.suggest = nil
+	}
+	return e.suggestions
+}
+
+// RelativeTo changes Target, and its suggestions, to be relative to 'dir', for
+// targets that were given relative to that directory.
+func (e *NoRuleError) RelativeTo(dir string) {
+	relTo := func(path string) string {
+		if r, err := rel(dir, path); err == nil {
+			return r
+		}
+		return path
+	}
+	e.Target = relTo(e.Target)
+	for i, s := range e.suggestions {
+		e.suggestions[i] = relTo(s)
+	}
+	if suggest := e.suggest; suggest != nil {
+		e.suggest = func() []string {
+			suggestions := suggest()
+			for i, s := range suggestions {
+				suggestions[i] = relTo(s)
+			}
+			return suggestions
+		}
+	}
+}
+
+func (e *NoRuleError) Error() string {
+	msg := fmt.Sprintf("no rule to knit target '%s'", e.Target)
+	if e.Rule != "" {
+		msg += fmt.Sprintf(" (required by '%s' at %s)", e.Rule, e.Location)
+	}
+	suggestions := e.Suggestions()
+	switch len(suggestions) {
+	case 0:
+	case 1:
+		msg += fmt.Sprintf("; did you mean '%s'?", suggestions[0])
+	default:
+		msg += fmt.Sprintf("; did you mean one of '%s'?", strings.Join(suggestions, "', '"))
+	}
+	return msg
+}
+
 func loadDeps(dir string, prereqs []prereq, depfile string, target string, opt map[int]bool) []prereq {
 	dep, err := os.ReadFile(depfile)
 	if err != nil {
 		return prereqs
 	}
 	rs := NewRuleSet(dir)
-	err = ParseInto(string(dep), rs, depfile, 1)
+	err = ParseInto(string(dep), rs, depfile, 1, RuleOpts{})
 	if err != nil {
 		return prereqs
 	}
@@ -508,6 +818,91 @@ func loadDeps(dir string, prereqs []prereq, depfile string, target string, opt m
 	return prereqs
 }
 
+func hasPrereq(prereqs []prereq, name string) bool {
+	for _, p := range prereqs {
+		if filepath.Clean(p.name) == filepath.Clean(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Loads the dyndep file of 'n' (a dependency file that was built by one of
+// its prereqs) and adds the prereqs that it lists for the targets of 'n' to
+// the graph. Returns the nodes for prereqs that were not already prereqs of
+// 'n'. If 'missingOK' is true, a dyndep file that does not exist is treated
+// as empty.
+func (g *Graph) addDyndeps(n *node, missingOK bool) ([]*node, error) {
+	file := pathJoin(n.dir, n.rule.attrs.Dyndep)
+	data, err := os.ReadFile(file)
+	if errors.Is(err, fs.ErrNotExist) && missingOK {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not load dyndep file: %w", err)
+	}
+	rs := NewRuleSet(n.dir)
+	if err := ParseInto(string(data), rs, file, 1, RuleOpts{}); err != nil {
+		return nil, err
+	}
+
+	have := make(map[*info]bool)
+	for _, p := range n.prereqs {
+		have[p.info] = true
+	}
+	var added []*node
+	for _, t := range n.rule.targets {
+		for _, ri := range rs.targets[pathJoin(n.dir, t)] {
+			r := &rs.directRules[ri]
+			if len(r.recipe) != 0 {
+				return nil, fmt.Errorf("%s: dyndep file cannot contain recipes", r.location())
+			}
+			for _, p := range r.prereqs {
+				visits := make([]int, len(g.rules.metaRules))
+				pn, err := g.resolveTarget(prereq{attrs: p.attrs, name: pathJoin(n.dir, p.name)}, visits, g.updated)
+				if err != nil {
+					return nil, err
+				}
+				if have[pn.info] {
+					continue
+				}
+				if pn.reaches(n.info, make(map[*info]bool)) {
+					return nil, fmt.Errorf("%s: dyndep '%s' creates a cycle", r.location(), p.name)
+				}
+				if g.vm != nil {
+					if err := g.expandLocked(pn); err != nil {
+						return nil, err
+					}
+				}
+				have[pn.info] = true
+				n.prereqs = append(n.prereqs, pn)
+				added = append(added, pn)
+			}
+		}
+	}
+	if len(added) != 0 {
+		// the node's prereqs changed, so it must be checked again
+		n.memoized = [2]bool{}
+	}
+	return added, nil
+}
+
+// Returns true if 'target' is 'n' or one of its (indirect) prereqs.
+func (n *node) reaches(target *info, visited map[*info]bool) bool {
+	if n.info == target {
+		return true
+	}
+	if visited[n.info] {
+		return false
+	}
+	visited[n.info] = true
+	for _, p := range n.prereqs {
+		if p.reaches(target, visited) {
+			return true
+		}
+	}
+	return false
+}
+
 func prereqsStr(prereqs []prereq, onlyexp bool) []string {
 	exp := make([]string, 0, len(prereqs))
 	for _, p := range prereqs {
@@ -534,9 +929,22 @@ type VM interface {
 	SetVar(name string, val interface{})
 }
 
+// Expands the recipes of 'n' and its prereqs with the graph's VM while the
+// build is running. A VM that is also used by the build (for example by
+// recipe functions) can implement sync.Locker, and is locked while it is
+// used.
+func (g *Graph) expandLocked(n *node) error {
+	if l, ok := g.vm.(sync.Locker); ok {
+		l.Lock()
+		defer l.Unlock()
+	}
+	return n.expandRecipe(g.vm)
+}
+
 // ExpandRecipes evaluates all variables and expressions in the recipes for the
 // build
 func (g *Graph) ExpandRecipes(vm VM) error {
+	g.vm = vm
 	return g.base.expandRecipe(vm)
 }
 
@@ -587,13 +995,26 @@ func (n *node) expandRecipe(vm VM) error {
 
 // checks the graph for cycles starting at node n
 func checkCycles(n *node) error {
+	return findCycles(n, nil)
+}
+
+// Searches for cycles with a depth-first search. The nodes on the path from
+// the root to 'n' are in 'path'.
+func findCycles(n *node, path []*node) error {
 	n.visited = 1
+	path = append(path, n)
 	for _, p := range n.prereqs {
 		if p.visited == 1 {
-			return fmt.Errorf("cycle detected at rule %v", p.rule)
+			// the cycle starts where p is on the path (p's info may be shared
+			// by multiple nodes)
+			start := len(path) - 1
+			for start > 0 && path[start].info != p.info {
+				start--
+			}
+			return cycleError(append(path[start:len(path):len(path)], p))
 		}
 		if p.visited == 0 {
-			if err := checkCycles(p); err != nil {
+			if err := findCycles(p, path); err != nil {
 				return err
 			}
 		}
@@ -602,12 +1023,40 @@ func checkCycles(n *node) error {
 	return nil
 }
 
-// returns the last modified time for the oldest output of this node
-func (n *node) time() time.Time {
+// Returns an error describing the cycle formed by the nodes in 'cycle', where
+// the first and last nodes are the same. Each rule in the cycle is listed
+// with the location where it was defined.
+func cycleError(cycle []*node) error {
+	names := make([]string, 0, len(cycle))
+	for _, n := range cycle {
+		names = append(names, n2str(n))
+	}
+	buf := &strings.Builder{}
+	fmt.Fprintf(buf, "cycle detected: %s", strings.Join(names, " -> "))
+	for i, n := range cycle[:len(cycle)-1] {
+		loc := n.rule.sourceLocation()
+		switch {
+		case n.pattern != "":
+			fmt.Fprintf(buf, "\n    %s: from meta-rule '%s' at %s", names[i], n.pattern, loc)
+		case loc != "":
+			fmt.Fprintf(buf, "\n    %s: from rule at %s", names[i], loc)
+		}
+	}
+	return errors.New(buf.String())
+}
+
+// returns the last modified time for the oldest output of this node. A
+// directory target is treated as modified when it was last built, since its
+// recipe may not have modified any of the files in it.
+func (n *node) time(db *Database) time.Time {
 	t := time.Now()
 	for _, f := range n.outputs {
-		if f.t.Before(t) {
-			t = f.t
+		ft := f.t
+		if built := db.Trees[f.name]; n.rule.attrs.Tree && f.exists && built.After(ft) {
+			ft = built
+		}
+		if ft.Before(t) {
+			t = ft
 		}
 	}
 	return t
@@ -699,14 +1148,14 @@ func (n *node) outOfDateNoMemo(db *Database, hash bool, dynamic bool) UpdateReas
 
 		if hash {
 			if p.myOutput != nil {
-				has := db.Prereqs.has(n.rule.targets, p.myOutput.name, n.dir)
+				has := db.Prereqs.has(n.rule.targets, p.myOutput.name, p.myOutput.skip, n.dir)
 				if has == noHash {
 					return HashModified
 				} else if has == noTargets {
 					return Untracked
 				}
 			}
-		} else if !p.rule.attrs.Virtual && p.time().After(n.time()) {
+		} else if !p.rule.attrs.Virtual && p.time(db).After(n.time(db)) {
 			log.Println(p.myTarget, "is newer than", n.myTarget)
 			return TimeModified
 		}
@@ -714,7 +1163,7 @@ func (n *node) outOfDateNoMemo(db *Database, hash bool, dynamic bool) UpdateReas
 
 	// database doesn't have an entry for this recipe
 	if len(n.rule.recipe) != 0 {
-		has := db.Recipes.has(n.rule.targets, n.recipe, n.dir)
+		has := db.Recipes.has(n.rule.targets, n.recipeKey(), n.dir)
 		if has == noHash {
 			return RecipeModified
 		} else if has == noTargets {
@@ -744,10 +1193,10 @@ func (n *node) outOfDateNoMemo(db *Database, hash bool, dynamic bool) UpdateReas
 	return UpToDate
 }
 
-func (n *node) count(db *Database, full, hash bool, counted map[*info]bool) int {
+func (n *node) count(db *Database, full func(n *node) bool, hash bool, counted map[*info]bool) int {
 	s := 0
 	ood := n.outOfDate(db, hash, false)
-	if !full && ood == UpToDate {
+	if !full(n) && ood == UpToDate {
 		return 0
 	}
 	if ood != OnlyPrereqs && len(n.rule.recipe) != 0 {
@@ -763,7 +1212,7 @@ func (n *node) count(db *Database, full, hash bool, counted map[*info]bool) int
 	return s
 }
 
-func (g *Graph) steps(db *Database, full, hash bool) int {
+func (g *Graph) steps(db *Database, full func(n *node) bool, hash bool) int {
 	counted := make(map[*info]bool)
 	return g.base.count(db, full, hash, counted)
 }
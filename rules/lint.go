@@ -0,0 +1,165 @@
+package rules
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Names of targets that are usually virtual.
+var phonyNames = map[string]bool{
+	"all":       true,
+	"build":     true,
+	"check":     true,
+	"clean":     true,
+	"default":   true,
+	"dist":      true,
+	"distclean": true,
+	"docs":      true,
+	"fmt":       true,
+	"format":    true,
+	"install":   true,
+	"lint":      true,
+	"run":       true,
+	"test":      true,
+	"uninstall": true,
+}
+
+// Matches uses of the input variables in an unexpanded recipe.
+var inputRegex = regexp.MustCompile(`\$(inputs?\b|\(\s*inputs?\s*\)|\{inputs?\})`)
+
+// LintTool reports rules that are likely to be mistakes. It checks the rules
+// along with the graph for the special :all target, which depends on the
+// targets of every direct rule.
+type LintTool struct {
+	W io.Writer
+}
+
+type lintIssue struct {
+	file string
+	line int
+	msg  string
+}
+
+func (t *LintTool) Run(g *Graph, args []string) error {
+	rs := g.rules
+	var issues []lintIssue
+	report := func(b *baseRule, format string, a ...interface{}) {
+		issues = append(issues, lintIssue{
+			file: b.file,
+			line: b.line,
+			msg:  fmt.Sprintf(format, a...),
+		})
+	}
+
+	// direct rules with recipes that are overridden by later rules for the
+	// same target
+	targets := make([]string, 0, len(rs.targets))
+	for target := range rs.targets {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	shadowed := make(map[int]bool)
+	for _, target := range targets {
+		idxs := rs.targets[target]
+		last := -1
+		for i := len(idxs) - 1; i >= 0; i-- {
+			r := &rs.directRules[idxs[i]]
+			if len(r.recipe) == 0 {
+				continue
+			}
+			if last == -1 {
+				last = idxs[i]
+			} else if last != idxs[i] && !shadowed[idxs[i]] {
+				shadowed[idxs[i]] = true
+				report(&r.baseRule, "rule for '%s' is overridden by the rule at %s", target, rs.directRules[last].location())
+			}
+		}
+	}
+
+	for i := range rs.directRules {
+		r := &rs.directRules[i]
+		if r.file == "" {
+			// rules created by knit itself
+			continue
+		}
+		if !r.attrs.Virtual {
+			for _, t := range r.targets {
+				if phonyNames[t] {
+					report(&r.baseRule, "'%s' looks like a virtual target but does not have the V attribute", t)
+				}
+			}
+		}
+		t.checkInput(&r.baseRule, report)
+	}
+
+	for i := range rs.metaRules {
+		t.checkInput(&rs.metaRules[i].baseRule, report)
+	}
+
+	all, err := NewGraph(rs, ":all", nil, GraphOptions{})
+	if err != nil {
+		fmt.Fprintf(t.W, "could not create graph for ':all': %v\n", err)
+	} else {
+		for i := range rs.metaRules {
+			mr := &rs.metaRules[i]
+			if !all.metaUsed[i] {
+				report(&mr.baseRule, "meta-rule is not used to build the targets of any direct rule or their prereqs")
+			}
+		}
+
+		// file targets that depend on virtual targets
+		seen := make(map[*info]bool)
+		for _, n := range all.nodes {
+			if seen[n.info] || n.rule.file == "" || n.rule.attrs.Virtual {
+				continue
+			}
+			seen[n.info] = true
+			for _, p := range n.prereqs {
+				if p.rule.attrs.Virtual && !strings.HasPrefix(p.myTarget, ":") {
+					report(&n.rule.baseRule, "file target '%s' depends on virtual target '%s', so it is rebuilt whenever '%s' runs", n2str(n), n2str(p), n2str(p))
+				}
+			}
+		}
+	}
+
+	sort.SliceStable(issues, func(i, j int) bool {
+		if issues[i].file != issues[j].file {
+			return issues[i].file < issues[j].file
+		}
+		if issues[i].line != issues[j].line {
+			return issues[i].line < issues[j].line
+		}
+		return issues[i].msg < issues[j].msg
+	})
+	for _, is := range issues {
+		fmt.Fprintf(t.W, "%s:%d: %s\n", is.file, is.line, is.msg)
+	}
+	if len(issues) != 0 {
+		return fmt.Errorf("%d issue(s) found", len(issues))
+	}
+	return nil
+}
+
+// Reports rules that use $input even though they have no explicit prereqs.
+func (t *LintTool) checkInput(b *baseRule, report func(b *baseRule, format string, a ...interface{})) {
+	if len(b.recipe) == 0 || !inputRegex.MatchString(strings.Join(b.recipe, "\n")) {
+		return
+	}
+	for _, p := range b.prereqs {
+		if !p.attrs.Implicit {
+			return
+		}
+	}
+	if len(b.prereqs) == 0 {
+		report(b, "recipe uses $input but the rule has no prereqs")
+	} else {
+		report(b, "recipe uses $input but all of the rule's prereqs are implicit")
+	}
+}
+
+func (t *LintTool) String() string {
+	return "lint - report common mistakes in rules"
+}
@@ -17,6 +17,7 @@ type parser struct {
 	file     string
 	tokenbuf []token  // tokens consumed on the current statement
 	rules    *RuleSet // current ruleSet
+	opts     RuleOpts // options applied to every parsed rule
 
 	errexpand expand.Resolver
 
@@ -70,7 +71,8 @@ func (p *parser) clear() {
 type parserStateFun func(*parser, token) parserStateFun
 
 // ParseInto parses 'input' into the rules RuleSet, from the file at 'file'.
-func ParseInto(input string, rules *RuleSet, file string, line int) error {
+// The options in 'opts' are attached to every rule that is parsed.
+func ParseInto(input string, rules *RuleSet, file string, line int, opts RuleOpts) error {
 	input = strings.TrimSpace(input)
 	l := lex(input, line)
 	p := &parser{
@@ -78,6 +80,7 @@ func ParseInto(input string, rules *RuleSet, file string, line int) error {
 		file:     file,
 		tokenbuf: []token{},
 		rules:    rules,
+		opts:     opts,
 		// This function is used to "expand" targets and prereqs. All
 		// expansions in targets/prereqs must have been resolved during Lua
 		// evaluation, so they are now all errors. The errors have to be thrown
@@ -204,6 +207,11 @@ func parseRecipe(p *parser, t token) parserStateFun {
 	var meta bool
 
 	base.dir = p.rules.dir
+	base.opts = p.opts
+	base.file = p.file
+	if len(p.tokenbuf) > 0 {
+		base.line = p.tokenbuf[0].line
+	}
 
 	// find one or two colons
 	i := 0
@@ -216,7 +224,20 @@ func parseRecipe(p *parser, t token) parserStateFun {
 	// rule has attributes
 	if j < len(p.tokenbuf) {
 		attribs := &bytes.Buffer{}
+		inside := false
 		for k := i + 1; k < j; k++ {
+			switch p.tokenbuf[k].typ {
+			case tokenLSquare:
+				inside = true
+			case tokenRSquare:
+				inside = false
+			case tokenWord:
+				// words inside brackets (such as the arguments of an
+				// interpreter) keep the spaces between them
+				if inside && p.tokenbuf[k-1].typ == tokenWord {
+					attribs.WriteByte(' ')
+				}
+			}
 			attribs.WriteString(p.tokenbuf[k].val)
 		}
 		attrs, err := ParseAttribs(attribs.String())
@@ -258,7 +279,8 @@ func parseRecipe(p *parser, t token) parserStateFun {
 					p.basicErrorAtToken(msg, p.tokenbuf[k])
 				}
 				patterns = append(patterns, Pattern{
-					Regex: rpat,
+					Regex:  rpat,
+					Source: str,
 				})
 			} else {
 				idx := strings.IndexRune(str, '%')
@@ -280,6 +302,7 @@ func parseRecipe(p *parser, t token) parserStateFun {
 					patterns = append(patterns, Pattern{
 						Regex:  rpat,
 						Suffix: true,
+						Source: str,
 					})
 				}
 			}
@@ -366,6 +389,14 @@ func parseRecipe(p *parser, t token) parserStateFun {
 	if t.typ == tokenRecipe {
 		base.recipe = parseCommands(stripIndentation(t.val, t.col))
 	}
+	if p.opts.Func != nil {
+		if len(base.recipe) != 0 {
+			p.basicErrorAtToken("rule cannot have both a recipe and a function", t)
+		}
+		// the function's name stands in for the recipe, so that the rule is
+		// treated as having one, and the name is displayed when it runs
+		base.recipe = []string{"# " + p.opts.Func.Name}
+	}
 
 	if meta {
 		r = MetaRule{
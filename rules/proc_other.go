@@ -0,0 +1,14 @@
+//go:build !unix
+
+package rules
+
+import (
+	"os/exec"
+)
+
+// Process groups are not supported, so only 'cmd' itself is killed.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+func killProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
@@ -0,0 +1,20 @@
+//go:build unix
+
+package rules
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// Makes 'cmd' run in its own process group, so that the processes it starts
+// can be killed along with it.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// Kills the process group of 'cmd', which must have been started after a
+// call to setProcessGroup.
+func killProcessGroup(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
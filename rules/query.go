@@ -0,0 +1,164 @@
+package rules
+
+import (
+	"path/filepath"
+)
+
+// A RuleInfo describes a rule and the location where it was defined. It is
+// used by tools that inspect a ruleset without building it, such as the
+// language server.
+type RuleInfo struct {
+	Targets []string // target names, or the regular expressions of a meta-rule
+	Prereqs []string
+	Recipe  []string // unexpanded recipe
+	Attrs   AttrSet
+	Dir     string
+	Meta    bool
+	File    string
+	Line    int
+}
+
+func (b *baseRule) info(targets []string, meta bool) RuleInfo {
+	prereqs := make([]string, 0, len(b.prereqs))
+	for _, p := range b.prereqs {
+		prereqs = append(prereqs, p.name)
+	}
+	return RuleInfo{
+		Targets: targets,
+		Prereqs: prereqs,
+		Recipe:  b.recipe,
+		Attrs:   b.attrs,
+		Dir:     b.dir,
+		Meta:    meta,
+		File:    b.file,
+		Line:    b.line,
+	}
+}
+
+func (r *DirectRule) info() RuleInfo {
+	return r.baseRule.info(r.targets, false)
+}
+
+func (r *MetaRule) info() RuleInfo {
+	targets := make([]string, 0, len(r.targets))
+	for _, t := range r.targets {
+		targets = append(targets, t.Regex.String())
+	}
+	return r.baseRule.info(targets, true)
+}
+
+// Rules returns a description of every rule in the ruleset. Direct rules are
+// listed first, followed by meta-rules, each in the order they were defined.
+func (rs *RuleSet) Rules() []RuleInfo {
+	infos := make([]RuleInfo, 0, len(rs.directRules)+len(rs.metaRules))
+	for i := range rs.directRules {
+		infos = append(infos, rs.directRules[i].info())
+	}
+	for i := range rs.metaRules {
+		infos = append(infos, rs.metaRules[i].info())
+	}
+	return infos
+}
+
+// Definitions returns the rules that may be used to build 'target': the direct
+// rules that list it as a target, or if there are none, the meta-rules that
+// match it.
+func (rs *RuleSet) Definitions(target string) []RuleInfo {
+	target = filepath.Clean(target)
+	infos := make([]RuleInfo, 0)
+	for _, idx := range rs.targets[target] {
+		infos = append(infos, rs.directRules[idx].info())
+	}
+	if len(infos) != 0 {
+		return infos
+	}
+	for i := range rs.metaRules {
+		mr := &rs.metaRules[i]
+		rel, err := filepath.Rel(mr.dir, target)
+		if err != nil {
+			continue
+		}
+		if sub, _ := mr.Match(rel); sub != nil {
+			infos = append(infos, mr.info())
+		}
+	}
+	return infos
+}
+
+// Recipe returns the recipe that builds the graph's target. The recipe is only
+// expanded after a call to ExpandRecipes.
+func (g *Graph) Recipe() []string {
+	if g.base.expanded {
+		return g.base.recipe
+	}
+	return g.base.rule.recipe
+}
+
+// A NodeInfo describes a step of a build graph.
+type NodeInfo struct {
+	Target  string   // target that the step was created for
+	Targets []string // all targets built by the step's recipe
+	Prereqs []string // targets of the steps that it depends on
+	Recipe  []string // recipe, which is only expanded after ExpandRecipes
+	Dir     string   // directory that the recipe runs in
+	Rule    RuleInfo // rule that provides the step's recipe
+}
+
+func (n *node) nodeInfo() NodeInfo {
+	prereqs := make([]string, 0, len(n.prereqs))
+	for _, p := range n.prereqs {
+		prereqs = append(prereqs, p.myTarget)
+	}
+	recipe := n.rule.recipe
+	if n.expanded {
+		recipe = n.recipe
+	}
+	return NodeInfo{
+		Target:  n.myTarget,
+		Targets: n.rule.targets,
+		Prereqs: prereqs,
+		Recipe:  recipe,
+		Dir:     n.execDir(),
+		Rule:    n.rule.info(),
+	}
+}
+
+// Nodes returns the steps of the graph, with each step listed after the steps
+// that it depends on. The last step is the graph's target.
+func (g *Graph) Nodes() []NodeInfo {
+	infos := make([]NodeInfo, 0, len(g.nodes))
+	visited := make(map[*node]bool)
+	var visit func(n *node)
+	visit = func(n *node) {
+		if visited[n] {
+			return
+		}
+		visited[n] = true
+		for _, p := range n.prereqs {
+			visit(p)
+		}
+		infos = append(infos, n.nodeInfo())
+	}
+	visit(g.base)
+	return infos
+}
+
+// Node returns the step that builds 'target', if it is part of the graph.
+func (g *Graph) Node(target string) (NodeInfo, bool) {
+	n, ok := g.fullNodes[filepath.Clean(target)]
+	if !ok {
+		return NodeInfo{}, false
+	}
+	return n.nodeInfo(), true
+}
+
+// Status returns the reason that the step that builds 'target' must be run,
+// or UpToDate if it does not need to be. Returns false if 'target' is not part
+// of the graph.
+func (g *Graph) Status(target string, db *Database, hash bool) (UpdateReason, bool) {
+	n, ok := g.fullNodes[filepath.Clean(target)]
+	if !ok {
+		return UpToDate, false
+	}
+	return n.outOfDate(db, hash, false), true
+}
@@ -16,10 +16,81 @@ type baseRule struct {
 	attrs   AttrSet
 	recipe  []string
 	dir     string
+	opts    RuleOpts
+
+	// location where the rule was defined
+	file string
+	line int
+}
+
+// RuleOpts holds per-rule settings that are provided by the Lua program that
+// created the rule, rather than by the rule's text.
+type RuleOpts struct {
+	Env   []string    // additional environment variables, in the form 'key=value'
+	Dir   string      // directory to run the recipe in, relative to the rule's directory
+	Func  *RecipeFunc // function to run instead of a recipe
+	Image string      // container image to run the recipe in
+}
+
+func (o *RuleOpts) equals(other *RuleOpts) bool {
+	if (o.Func == nil) != (other.Func == nil) {
+		return false
+	}
+	if o.Func != nil && (o.Func.Name != other.Func.Name || o.Func.Key != other.Func.Key) {
+		return false
+	}
+	return o.Dir == other.Dir && o.Image == other.Image && equal(o.Env, other.Env)
+}
+
+// A RecipeFunc is a recipe implemented by a function (usually a Lua function)
+// rather than by shell commands.
+type RecipeFunc struct {
+	Name string // displayed in place of the recipe's commands
+	Key  string // changes when the function changes, so that its rule is rebuilt
+	Call func(ctx RecipeContext) error
+}
+
+// A RecipeContext describes the step that a RecipeFunc must perform. All paths
+// are relative to the root of the build.
+type RecipeContext struct {
+	Dir     string   // directory of the rule
+	Inputs  []string // prereqs that would be substituted for $input
+	Outputs []string // targets of the rule
+	Match   string   // value captured by a % meta-rule
+	Matches []string // values captured by a regex meta-rule
+	Dep     string   // dependency file, if the rule has one
 }
 
 func (b baseRule) isRule() {}
 
+// Returns the location where the rule was defined, as 'file:line'.
+func (b *baseRule) location() string {
+	return fmt.Sprintf("%s:%d", b.file, b.line)
+}
+
+// Returns the location where the rule was defined, or the empty string if the
+// rule was not defined in a file (for example, the special ':build' rule).
+func (b *baseRule) sourceLocation() string {
+	if b.file == "" {
+		return ""
+	}
+	return b.location()
+}
+
+// A LocationError is an error caused by the rule defined at Location.
+type LocationError struct {
+	Location string // 'file:line' of the rule
+	Err      error
+}
+
+func (e *LocationError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Location, e.Err)
+}
+
+func (e *LocationError) Unwrap() error {
+	return e.Err
+}
+
 func (b *baseRule) prereqsString() string {
 	buf := &bytes.Buffer{}
 	for i, p := range b.prereqs {
@@ -72,7 +143,8 @@ func equal[T comparable](a, b []T) bool {
 func (r *DirectRule) Equals(other *DirectRule) bool {
 	return r.attrs == other.attrs &&
 		equal(r.prereqs, other.prereqs) &&
-		equal(r.recipe, other.recipe)
+		equal(r.recipe, other.recipe) &&
+		r.opts.equals(&other.opts)
 }
 
 func (r *DirectRule) String() string {
@@ -120,6 +192,12 @@ type AttrSet struct {
 	Implicit bool   // not listed in $input
 	Dep      string // dependency file
 	Order    bool
+	OneShell bool   // run the whole recipe in a single shell
+	Interp   string // interpreter that runs the recipe
+	Dyndep   string // dependency file built by a prereq during the build
+	Generate bool   // builds part of the build description
+	Tree     bool   // targets are directories
+	TreeSkip string // glob patterns for files to ignore in target directories
 }
 
 func (a *AttrSet) UpdateFrom(other AttrSet) {
@@ -132,11 +210,13 @@ func (a *AttrSet) UpdateFrom(other AttrSet) {
 	a.Linked = a.Linked || other.Linked
 	a.Order = a.Order || other.Order
 	a.Implicit = a.Implicit || other.Implicit
+	a.OneShell = a.OneShell || other.OneShell
 }
 
 type Pattern struct {
 	Suffix bool
 	Regex  *regexp.Regexp
+	Source string // the pattern as it was written in the rule
 }
 
 type RuleSet struct {
@@ -189,6 +269,21 @@ func (rs *RuleSet) MainTarget() string {
 	return rs.directRules[0].targets[0]
 }
 
+// Generators returns the targets of the rules with the G attribute, which
+// build files that are used by the Knitfile.
+func (rs *RuleSet) Generators() []string {
+	var targets []string
+	for _, r := range rs.directRules {
+		if !r.attrs.Generate {
+			continue
+		}
+		for _, t := range r.targets {
+			targets = append(targets, pathJoin(r.dir, t))
+		}
+	}
+	return targets
+}
+
 func (rs *RuleSet) AllTargets() []string {
 	targets := make([]string, 0, len(rs.targets))
 	for k := range rs.targets {
@@ -229,29 +324,41 @@ func ParseAttribs(input string) (AttrSet, error) {
 			attrs.Order = true
 		case 'I':
 			attrs.Implicit = true
+		case 'S':
+			attrs.OneShell = true
+		case 'G':
+			attrs.Generate = true
 		case 'D':
-			if r.Len() == 0 {
-				return attrs, fmt.Errorf("attribute: no contents found after D")
+			dep, err := bracketArg(r, c)
+			if err != nil {
+				return attrs, err
+			}
+			attrs.Dep = dep
+		case 'X':
+			interp, err := bracketArg(r, c)
+			if err != nil {
+				return attrs, err
 			}
-			c, _, _ = r.ReadRune()
-			dep := &bytes.Buffer{}
-			if c == '[' {
-				found := false
-				for r.Len() > 0 {
-					c, _, _ = r.ReadRune()
-					if c == ']' {
-						found = true
-						break
-					}
-					dep.WriteRune(c)
+			attrs.Interp = interp
+		case 'T':
+			attrs.Tree = true
+			if c, _, err := r.ReadRune(); err == nil {
+				r.UnreadRune()
+				if c != '[' {
+					break
 				}
-				if !found {
-					return attrs, fmt.Errorf("attribute: no ']' found after D")
+				skip, err := bracketArg(r, 'T')
+				if err != nil {
+					return attrs, err
 				}
-			} else {
-				return attrs, fmt.Errorf("attribute: no '[' found after D")
+				attrs.TreeSkip = skip
+			}
+		case 'Y':
+			dyndep, err := bracketArg(r, c)
+			if err != nil {
+				return attrs, err
 			}
-			attrs.Dep = dep.String()
+			attrs.Dyndep = dyndep
 		default:
 			return attrs, attrError{c}
 		}
@@ -260,6 +367,26 @@ func ParseAttribs(input string) (AttrSet, error) {
 	return attrs, nil
 }
 
+// Reads the '[...]' argument that follows the attribute 'attr'.
+func bracketArg(r *strings.Reader, attr rune) (string, error) {
+	if r.Len() == 0 {
+		return "", fmt.Errorf("attribute: no contents found after %c", attr)
+	}
+	c, _, _ := r.ReadRune()
+	if c != '[' {
+		return "", fmt.Errorf("attribute: no '[' found after %c", attr)
+	}
+	arg := &bytes.Buffer{}
+	for r.Len() > 0 {
+		c, _, _ = r.ReadRune()
+		if c == ']' {
+			return arg.String(), nil
+		}
+		arg.WriteRune(c)
+	}
+	return "", fmt.Errorf("attribute: no ']' found after %c", attr)
+}
+
 func MergeRuleSets(first *RuleSet, rsets []*RuleSet) *RuleSet {
 	rs := NewRuleSet(".")
 
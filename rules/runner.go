@@ -0,0 +1,116 @@
+package rules
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+)
+
+// A Command is a process that the executor runs for a recipe.
+type Command struct {
+	Name string   // program to run
+	Args []string // arguments, not including the program name
+	Dir  string   // directory to run the command in
+	Env  []string // environment variables to set, in addition to Knit's own
+
+	// Files and directories that the command reads and writes, relative to
+	// the directory that Knit runs in (inputs may also be absolute). Runners
+	// that execute commands on another machine must transfer them, and the
+	// local runner ignores them.
+	Inputs  []string
+	Outputs []string
+
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// A Runner runs the commands of recipes. If the context is done before the
+// command finishes, the runner should stop the command and return.
+type Runner interface {
+	Run(ctx context.Context, cmd Command) error
+}
+
+// LocalRunner runs commands as processes on the local machine. It is the
+// default runner.
+type LocalRunner struct{}
+
+func (LocalRunner) Run(ctx context.Context, c Command) error {
+	cmd := exec.Command(c.Name, c.Args...)
+	cmd.Dir = c.Dir
+	cmd.Stdin = c.Stdin
+	if len(c.Env) != 0 {
+		cmd.Env = append(os.Environ(), c.Env...)
+	}
+
+	// Output to writers that are not files is copied from pipes, and all of
+	// it is copied before waiting for the command.
+	var copies []func()
+	pipe := func(w io.Writer, get func() (io.ReadCloser, error)) error {
+		r, err := get()
+		if err != nil {
+			return err
+		}
+		copies = append(copies, func() { io.Copy(w, r) })
+		return nil
+	}
+	if _, ok := c.Stdout.(*os.File); ok || c.Stdout == nil {
+		cmd.Stdout = c.Stdout
+	} else if err := pipe(c.Stdout, cmd.StdoutPipe); err != nil {
+		return err
+	}
+	if _, ok := c.Stderr.(*os.File); ok || c.Stderr == nil {
+		cmd.Stderr = c.Stderr
+	} else if err := pipe(c.Stderr, cmd.StderrPipe); err != nil {
+		return err
+	}
+
+	// If the build can be cancelled, the command runs in its own process
+	// group so that everything it started is killed when it is cancelled.
+	// Otherwise it stays in Knit's group, so that it receives signals from
+	// the terminal.
+	done := ctx.Done()
+	if done != nil {
+		setProcessGroup(cmd)
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	if done != nil {
+		exited := make(chan struct{})
+		defer close(exited)
+		go func() {
+			select {
+			case <-done:
+				killProcessGroup(cmd)
+			case <-exited:
+			}
+		}()
+	}
+	wg := sync.WaitGroup{}
+	for _, copy := range copies {
+		wg.Add(1)
+		go func(copy func()) {
+			copy()
+			wg.Done()
+		}(copy)
+	}
+	wg.Wait()
+	return cmd.Wait()
+}
+
+// A printerWriter writes to 'w' while the printer's status display is
+// cleared.
+type printerWriter struct {
+	p Printer
+	w io.Writer
+}
+
+func (pw *printerWriter) Write(b []byte) (int, error) {
+	pw.p.Clear()
+	n, err := pw.w.Write(b)
+	pw.p.Update()
+	return n, err
+}
@@ -0,0 +1,185 @@
+package rules
+
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Maximum number of suggestions for an unknown target.
+const maxSuggestions = 3
+
+// Returns the edit distance between 'a' and 'b', counting insertions,
+// deletions, substitutions, and transpositions of adjacent bytes.
+func editDistance(a, b string) int {
+	// d[i][j] is the distance between a[:i] and b[:j]
+	d := make([][]int, len(a)+1)
+	for i := range d {
+		d[i] = make([]int, len(b)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			d[i][j] = minInt(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				d[i][j] = minInt(d[i][j], d[i-2][j-2]+1)
+			}
+		}
+	}
+	return d[len(a)][len(b)]
+}
+
+// Returns the largest edit distance at which another name is considered a
+// likely misspelling of 'target'. Only the last element of the path is used,
+// since directory names are usually given correctly.
+func maxDistance(target string) int {
+	switch n := len(filepath.Base(target)) / 4; {
+	case n < 1:
+		return 1
+	case n > 3:
+		return 3
+	default:
+		return n
+	}
+}
+
+func minInt(a int, rest ...int) int {
+	for _, b := range rest {
+		if b < a {
+			a = b
+		}
+	}
+	return a
+}
+
+// Maximum number of files that are examined when looking for suggestions.
+const maxSuggestFiles = 10000
+
+// Returned by the function that walks the files in listFiles once enough
+// files have been found.
+var errEnoughFiles = errors.New("enough files found")
+
+// Returns the files under 'dir', relative to it, skipping hidden directories
+// (such as '.knit'), and stopping after maxSuggestFiles files.
+func listFiles(dir string) []string {
+	var files []string
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if len(files) >= maxSuggestFiles {
+			return errEnoughFiles
+		}
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			if path != dir && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if rel, err := filepath.Rel(dir, path); err == nil {
+			files = append(files, rel)
+		}
+		return nil
+	})
+	return files
+}
+
+// Returns the target that the meta-rule 'mr' would build with 'file' as its
+// first '%' prereq, or false if 'file' does not match that prereq.
+func (mr *MetaRule) targetFrom(file string) (string, bool) {
+	if len(mr.targets) == 0 || !mr.targets[0].Suffix {
+		return "", false
+	}
+	for _, p := range mr.prereqs {
+		left, right, ok := strings.Cut(pathJoin(mr.dir, p.name), "%")
+		if !ok {
+			continue
+		}
+		if len(file) <= len(left)+len(right) || !strings.HasPrefix(file, left) || !strings.HasSuffix(file, right) {
+			return "", false
+		}
+		stem := file[len(left) : len(file)-len(right)]
+		return strings.Replace(pathJoin(mr.dir, mr.targets[0].Source), "%", stem, 1), true
+	}
+	return "", false
+}
+
+// Suggest returns the targets that 'target' may have been intended to be,
+// with the most likely first. Candidates are the targets of direct rules
+// (including virtual rules), files under the current directory, and the
+// targets that meta-rules could build from those files. A candidate is
+// suggested if it is spelled similarly to 'target' or has the same name in a
+// different directory.
+func (rs *RuleSet) Suggest(target string) []string {
+	return rs.suggestIn(".", target)
+}
+
+// Returns the suggestions for 'target', with the files under 'dir' (the
+// directory that the rules are relative to) as candidates.
+func (rs *RuleSet) suggestIn(dir, target string) []string {
+	target = filepath.Clean(target)
+	dists := make(map[string]int)
+	add := func(s string, d int) {
+		if s == target {
+			return
+		}
+		if old, ok := dists[s]; !ok || d < old {
+			dists[s] = d
+		}
+	}
+
+	limit := maxDistance(target)
+	base := filepath.Base(target)
+	consider := func(c string) {
+		if d := editDistance(c, target); d <= limit {
+			add(c, d)
+		} else if filepath.Base(c) == base {
+			// same name in another directory, which is less likely than a
+			// misspelling
+			add(c, limit+1)
+		}
+	}
+
+	for t := range rs.targets {
+		if t != ":build" && t != ":build-root" {
+			consider(t)
+		}
+	}
+	for _, f := range listFiles(dir) {
+		consider(f)
+		for i := range rs.metaRules {
+			t, ok := rs.metaRules[i].targetFrom(f)
+			if ok && t == target {
+				// the target is spelled correctly, but some other prereq
+				// of the meta-rule is missing
+				return []string{}
+			} else if ok {
+				consider(t)
+			}
+		}
+	}
+	suggestions := make([]string, 0, len(dists))
+	for s := range dists {
+		suggestions = append(suggestions, s)
+	}
+	sort.Slice(suggestions, func(i, j int) bool {
+		a, b := suggestions[i], suggestions[j]
+		if dists[a] != dists[b] {
+			return dists[a] < dists[b]
+		}
+		return a < b
+	})
+	if len(suggestions) > maxSuggestions {
+		suggestions = suggestions[:maxSuggestions]
+	}
+	return suggestions
+}
@@ -9,6 +9,8 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
+
+	"github.com/kballard/go-shellquote"
 )
 
 func n2str(n *node) string {
@@ -28,6 +30,7 @@ var tools = []Tool{
 	&StatusTool{},
 	&PathTool{},
 	&DbTool{},
+	&LintTool{},
 }
 
 type Tool interface {
@@ -37,12 +40,17 @@ type Tool interface {
 
 type ListTool struct {
 	W io.Writer
+	// descriptions of tools that are provided outside of this package
+	Extra []string
 }
 
 func (t *ListTool) Run(g *Graph, args []string) error {
 	for _, tl := range tools {
 		fmt.Fprintln(t.W, tl)
 	}
+	for _, tl := range t.Extra {
+		fmt.Fprintln(t.W, tl)
+	}
 
 	return nil
 }
@@ -181,6 +189,19 @@ func (t *CleanTool) Run(g *Graph, args []string) error {
 		}
 		fmt.Fprintln(t.W, "remove", o)
 	}
+	// directory targets are removed with all of their contents, including
+	// the files that are ignored when checking if they were modified
+	for dir := range t.Db.Trees {
+		if !t.NoExec {
+			err := os.RemoveAll(dir)
+			delete(t.Db.Trees, dir)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				continue
+			}
+		}
+		fmt.Fprintln(t.W, "remove", dir)
+	}
 	for o := range t.Db.OutputDirs {
 		err := t.removeEmpty(o)
 		if err != nil {
@@ -333,6 +354,27 @@ type BuildCommand struct {
 	Outputs   []string `json:"outputs"`
 	Commands  []string `json:"command"`
 	Name      string   `json:"name"`
+	Env       []string `json:"env,omitempty"`
+	Image     string   `json:"image,omitempty"`    // container image that the commands run in
+	Location  string   `json:"location,omitempty"` // where the rule was defined
+}
+
+// Returns the shell commands that must be run before each of this command's
+// recipe lines, to set up the directory and environment.
+func (c *BuildCommand) prefix() string {
+	buf := &bytes.Buffer{}
+	if c.Directory != "." && c.Directory != "" {
+		buf.WriteString("cd " + c.Directory + "; ")
+	}
+	buf.WriteString(envPrefix(c.Env))
+	return buf.String()
+}
+
+func envPrefix(env []string) string {
+	if len(env) == 0 {
+		return ""
+	}
+	return "export " + shellquote.Join(env...) + "; "
 }
 
 func (c *BuildCommand) toMake(w io.Writer) {
@@ -350,10 +392,7 @@ func (c *BuildCommand) toMake(w io.Writer) {
 	buf.WriteString(strings.Join(c.Prereqs, " "))
 	buf.WriteByte('\n')
 
-	cd := ""
-	if c.Directory != "." && c.Directory != "" {
-		cd = "cd " + c.Directory + "; "
-	}
+	cd := c.prefix()
 	for _, cmd := range c.Commands {
 		buf.WriteByte('\t')
 		buf.WriteString(cd + cmd)
@@ -376,10 +415,7 @@ func (c *BuildCommand) toKnit(w io.Writer) {
 	buf.WriteString(strings.Join(c.Prereqs, " "))
 	buf.WriteByte('\n')
 
-	cd := ""
-	if c.Directory != "." && c.Directory != "" {
-		cd = "cd " + c.Directory + "; "
-	}
+	cd := c.prefix()
 	for _, cmd := range c.Commands {
 		buf.WriteByte('\t')
 		buf.WriteString(cd + cmd)
@@ -391,11 +427,7 @@ func (c *BuildCommand) toKnit(w io.Writer) {
 func (c *BuildCommand) toNinja(w io.Writer) {
 	if len(c.Commands) > 0 {
 		fmt.Fprintf(w, "rule %s\n", strings.Replace(c.Name, "/", "_", -1))
-		cd := ""
-		if c.Directory != "." && c.Directory != "" {
-			cd = "cd " + c.Directory + "; "
-		}
-		fmt.Fprintf(w, "  command = %s%s\n", cd, strings.Join(c.Commands, "; "))
+		fmt.Fprintf(w, "  command = %s%s\n", c.prefix(), strings.Join(c.Commands, "; "))
 	}
 	out := c.Name
 	if len(c.Outputs) > 1 {
@@ -429,12 +461,15 @@ func (t *CommandsTool) commands(n *node, visited map[*info]bool, cmds BuildRules
 		}
 
 		cmds = append(cmds, BuildCommand{
-			Directory: n.dir,
+			Directory: n.execDir(),
 			Prereqs:   prs,
 			Inputs:    inputs,
 			Outputs:   outputs,
 			Name:      filepath.Join(n.dir, n.myTarget),
 			Commands:  n.recipe,
+			Env:       n.rule.opts.Env,
+			Image:     n.rule.opts.Image,
+			Location:  n.rule.sourceLocation(),
 		})
 	}
 
@@ -456,8 +491,11 @@ func (t *CommandsTool) shell(n *node, visited map[*info]bool, w io.Writer) {
 		t.shell(p, visited, w)
 	}
 	cd := ""
-	if n.dir != "." && n.dir != "" {
-		cd = "cd " + n.dir + ";"
+	if dir := n.execDir(); dir != "." && dir != "" {
+		cd = "cd " + dir + ";"
+	}
+	if env := envPrefix(n.rule.opts.Env); env != "" {
+		cd = strings.TrimSpace(cd + " " + strings.TrimSuffix(env, " "))
 	}
 	for _, c := range n.recipe {
 		var cmd string
@@ -516,7 +554,11 @@ func (t *StatusTool) visit(prev UpdateReason, indent string, n *node, visited ma
 	if n.rule.attrs.Linked && status == UpToDate && prev != UpToDate {
 		status = LinkedUpdate
 	}
-	fmt.Fprintf(t.W, "%s%s: [%s]\n", indent, n2str(n), status)
+	if loc := n.rule.sourceLocation(); loc != "" {
+		fmt.Fprintf(t.W, "%s%s: [%s] (%s)\n", indent, n2str(n), status, loc)
+	} else {
+		fmt.Fprintf(t.W, "%s%s: [%s]\n", indent, n2str(n), status)
+	}
 	if visited[n] && len(n.prereqs) > 0 {
 		fmt.Fprintf(t.W, "%s  ...\n", indent)
 		return
@@ -0,0 +1,194 @@
+package rules
+
+import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	shellquote "github.com/kballard/go-shellquote"
+)
+
+// A Worker is a machine that runs commands for an SSHRunner.
+type Worker struct {
+	// destination for ssh (such as 'user@host'), or empty for the local
+	// machine
+	Host string
+	// maximum number of commands that run on the worker at once (1 if not
+	// positive)
+	Jobs int
+	// build directory on the worker (the same path as on the local machine
+	// if empty)
+	Dir string
+	// copy the inputs of each command to the worker with rsync before
+	// running it, and its outputs back afterwards, for workers that do not
+	// share a filesystem with the local machine
+	Sync bool
+}
+
+func (w *Worker) jobs() int {
+	if w.Jobs <= 0 {
+		return 1
+	}
+	return w.Jobs
+}
+
+// An SSHRunner runs each command on one of a set of workers that has a free
+// slot, using ssh. Commands are run in the worker's build directory, with
+// programs given by absolute paths replaced by their names, since the worker
+// may have them in a different location. Inputs outside of the build
+// directory (such as the scripts of recipes with an interpreter) are always
+// copied to the worker with rsync, to the same path.
+type SSHRunner struct {
+	workers []Worker
+	// indices of workers, with one entry for each free slot
+	slots chan int
+	// runs the ssh and rsync commands
+	runner Runner
+}
+
+// NewSSHRunner returns a runner that dispatches commands to 'workers', and
+// runs the ssh and rsync commands that it needs with 'runner' (LocalRunner if
+// nil).
+func NewSSHRunner(workers []Worker, runner Runner) *SSHRunner {
+	if runner == nil {
+		runner = LocalRunner{}
+	}
+	r := &SSHRunner{
+		workers: workers,
+		runner:  runner,
+	}
+	r.slots = make(chan int, r.Jobs())
+	// interleave the slots, so that commands are spread across workers
+	for j := 0; len(r.slots) < cap(r.slots); j++ {
+		for i := range workers {
+			if j < workers[i].jobs() {
+				r.slots <- i
+			}
+		}
+	}
+	return r
+}
+
+// Jobs returns the total number of commands that may run at once on all of
+// the workers.
+func (r *SSHRunner) Jobs() int {
+	return WorkerJobs(r.workers)
+}
+
+// WorkerJobs returns the total number of commands that may run at once on
+// 'workers'.
+func WorkerJobs(workers []Worker) int {
+	n := 0
+	for i := range workers {
+		n += workers[i].jobs()
+	}
+	return n
+}
+
+func (r *SSHRunner) Run(ctx context.Context, c Command) error {
+	var i int
+	select {
+	case i = <-r.slots:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { r.slots <- i }()
+
+	w := &r.workers[i]
+	if w.Host == "" {
+		return r.runner.Run(ctx, c)
+	}
+
+	root, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	dir := w.Dir
+	if dir == "" {
+		dir = filepath.ToSlash(root)
+	}
+	// paths relative to the build directory, and absolute paths outside of
+	// it
+	local := func(p string) (string, bool) {
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(root, p)
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return p, false
+		}
+		return rel, true
+	}
+
+	var inputs, external []string
+	for _, p := range c.Inputs {
+		if rel, ok := local(p); ok {
+			if w.Sync {
+				inputs = append(inputs, rel)
+			}
+		} else {
+			external = append(external, p)
+		}
+	}
+	if len(inputs) > 0 {
+		// rsync recreates the relative paths of the inputs in the worker's
+		// build directory, which is created first
+		args := []string{"-aR", "--ignore-missing-args", "--rsync-path", "mkdir -p " + shellquote.Join(dir) + " && rsync", "--"}
+		args = append(args, inputs...)
+		if err := r.rsync(ctx, c, append(args, w.Host+":"+dir+"/")); err != nil {
+			return err
+		}
+	}
+	if len(external) > 0 {
+		args := append([]string{"-aR", "--ignore-missing-args", "--"}, external...)
+		if err := r.rsync(ctx, c, append(args, w.Host+":/")); err != nil {
+			return err
+		}
+	}
+
+	wd, _ := local(c.Dir)
+	script := "cd " + shellquote.Join(path.Join(dir, filepath.ToSlash(wd))) + " && "
+	if len(c.Env) > 0 {
+		script += "env " + shellquote.Join(c.Env...) + " "
+	}
+	name := c.Name
+	if filepath.IsAbs(name) {
+		name = filepath.Base(name)
+	}
+	script += shellquote.Join(append([]string{name}, c.Args...)...)
+	err = r.runner.Run(ctx, Command{
+		Name:   "ssh",
+		Args:   []string{"-n", "-o", "BatchMode=yes", w.Host, script},
+		Stdout: c.Stdout,
+		Stderr: c.Stderr,
+	})
+	if err != nil || !w.Sync || len(c.Outputs) == 0 {
+		return err
+	}
+
+	// the '/./' in each path marks the part that rsync recreates locally,
+	// and paths after the first are on the same host
+	var srcs []string
+	for _, o := range c.Outputs {
+		if rel, ok := local(o); ok {
+			srcs = append(srcs, ":"+dir+"/./"+filepath.ToSlash(rel))
+		}
+	}
+	if len(srcs) == 0 {
+		return nil
+	}
+	srcs[0] = w.Host + srcs[0]
+	args := append([]string{"-aR", "--ignore-missing-args", "--"}, srcs...)
+	return r.rsync(ctx, c, append(args, "."))
+}
+
+func (r *SSHRunner) rsync(ctx context.Context, c Command, args []string) error {
+	return r.runner.Run(ctx, Command{
+		Name:   "rsync",
+		Args:   args,
+		Stdout: c.Stdout,
+		Stderr: c.Stderr,
+	})
+}
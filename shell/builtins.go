@@ -0,0 +1,382 @@
+package shell
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"mvdan.cc/sh/interp"
+)
+
+// A builtin implements a command without relying on an external program, so
+// that recipes using the internal shell can run on systems without coreutils.
+// Builtins are only used when the program of the same name cannot be found.
+type builtin func(mc interp.ModuleCtx, flags map[rune]bool, args []string) error
+
+type builtinCmd struct {
+	flags string // flags accepted by the builtin
+	fn    builtin
+}
+
+var builtins = map[string]builtinCmd{
+	"mkdir": {"p", mkdir},
+	"rm":    {"rfR", rm},
+	"cp":    {"rRf", cp},
+	"mv":    {"f", mv},
+	"touch": {"c", touch},
+	"cat":   {"", cat},
+	"ln":    {"sf", ln},
+	"subst": {"i", subst},
+}
+
+// errUnsupported is returned when a builtin is invoked with an option that it
+// does not implement.
+var errUnsupported = errors.New("unsupported option")
+
+// Parses leading flags in 'args' (such as '-rf'), and returns the flags along
+// with the remaining arguments.
+func parseFlags(accepted string, args []string) (map[rune]bool, []string, error) {
+	flags := make(map[rune]bool)
+	for len(args) > 0 {
+		a := args[0]
+		if a == "--" {
+			return flags, args[1:], nil
+		}
+		if len(a) < 2 || a[0] != '-' {
+			break
+		}
+		for _, r := range a[1:] {
+			if !strings.ContainsRune(accepted, r) {
+				return nil, nil, fmt.Errorf("%w: -%c", errUnsupported, r)
+			}
+			flags[r] = true
+		}
+		args = args[1:]
+	}
+	return flags, args, nil
+}
+
+// Exec is an interpreter module that executes programs normally, and runs
+// builtin commands for the programs that are not found ('path' is empty).
+func Exec(ctx context.Context, path string, args []string) error {
+	cmd, ok := builtins[args[0]]
+	if !ok || path != "" {
+		return interp.DefaultExec(ctx, path, args)
+	}
+	mc, _ := interp.FromModuleContext(ctx)
+	flags, rest, err := parseFlags(cmd.flags, args[1:])
+	if err == nil {
+		err = cmd.fn(mc, flags, rest)
+	}
+	if err != nil {
+		fmt.Fprintf(mc.Stderr, "%s: %v\n", args[0], err)
+		return interp.ExitStatus(1)
+	}
+	return nil
+}
+
+func abs(mc interp.ModuleCtx, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(mc.Dir, path)
+}
+
+func mkdir(mc interp.ModuleCtx, flags map[rune]bool, args []string) error {
+	for _, a := range args {
+		var err error
+		if flags['p'] {
+			err = os.MkdirAll(abs(mc, a), 0777)
+		} else {
+			err = os.Mkdir(abs(mc, a), 0777)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func rm(mc interp.ModuleCtx, flags map[rune]bool, args []string) error {
+	recursive := flags['r'] || flags['R']
+	for _, a := range args {
+		p := abs(mc, a)
+		info, err := os.Lstat(p)
+		if err != nil {
+			if flags['f'] && errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return err
+		}
+		if info.IsDir() && !recursive {
+			return fmt.Errorf("%s: is a directory", a)
+		}
+		if recursive {
+			err = os.RemoveAll(p)
+		} else {
+			err = os.Remove(p)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the destination for each source when moving or copying 'srcs' to
+// 'dst'. If there are multiple sources, 'dst' must be a directory.
+func destinations(mc interp.ModuleCtx, args []string) ([]string, []string, error) {
+	if len(args) < 2 {
+		return nil, nil, errors.New("missing destination operand")
+	}
+	srcs, dst := args[:len(args)-1], abs(mc, args[len(args)-1])
+	info, err := os.Stat(dst)
+	isdir := err == nil && info.IsDir()
+	if len(srcs) > 1 && !isdir {
+		return nil, nil, fmt.Errorf("%s: not a directory", args[len(args)-1])
+	}
+	from := make([]string, 0, len(srcs))
+	to := make([]string, 0, len(srcs))
+	for _, s := range srcs {
+		from = append(from, abs(mc, s))
+		if isdir {
+			to = append(to, filepath.Join(dst, filepath.Base(s)))
+		} else {
+			to = append(to, dst)
+		}
+	}
+	return from, to, nil
+}
+
+func cp(mc interp.ModuleCtx, flags map[rune]bool, args []string) error {
+	from, to, err := destinations(mc, args)
+	if err != nil {
+		return err
+	}
+	recursive := flags['r'] || flags['R']
+	for i := range from {
+		info, err := os.Stat(from[i])
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if !recursive {
+				return fmt.Errorf("%s: is a directory", from[i])
+			}
+			err = copyDir(from[i], to[i])
+		} else {
+			err = copyFile(from[i], to[i], info.Mode())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyDir(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return os.MkdirAll(target, info.Mode().Perm())
+		}
+		return copyFile(path, target, info.Mode())
+	})
+}
+
+func copyFile(src, dst string, mode fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode.Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func mv(mc interp.ModuleCtx, flags map[rune]bool, args []string) error {
+	from, to, err := destinations(mc, args)
+	if err != nil {
+		return err
+	}
+	for i := range from {
+		err := os.Rename(from[i], to[i])
+		if errors.Is(err, syscall.EXDEV) {
+			// files cannot be renamed across filesystems
+			err = move(from[i], to[i])
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Moves 'src' to 'dst' by copying it (keeping its modification time) and
+// removing the original.
+func move(src, dst string) error {
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		err = copyDir(src, dst)
+	} else {
+		err = copyFile(src, dst, info.Mode())
+		if err == nil {
+			err = os.Chtimes(dst, info.ModTime(), info.ModTime())
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(src)
+}
+
+func touch(mc interp.ModuleCtx, flags map[rune]bool, args []string) error {
+	now := time.Now()
+	for _, a := range args {
+		p := abs(mc, a)
+		err := os.Chtimes(p, now, now)
+		if errors.Is(err, fs.ErrNotExist) {
+			if flags['c'] {
+				continue
+			}
+			var f *os.File
+			f, err = os.Create(p)
+			if err == nil {
+				err = f.Close()
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Calls 'fn' with a reader for each file in 'args', or for stdin if there are
+// none. A file named '-' also refers to stdin.
+func eachInput(mc interp.ModuleCtx, args []string, fn func(r io.Reader) error) error {
+	if len(args) == 0 {
+		args = []string{"-"}
+	}
+	for _, a := range args {
+		if a == "-" {
+			if err := fn(mc.Stdin); err != nil {
+				return err
+			}
+			continue
+		}
+		f, err := os.Open(abs(mc, a))
+		if err != nil {
+			return err
+		}
+		err = fn(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func cat(mc interp.ModuleCtx, flags map[rune]bool, args []string) error {
+	return eachInput(mc, args, func(r io.Reader) error {
+		_, err := io.Copy(mc.Stdout, r)
+		return err
+	})
+}
+
+func ln(mc interp.ModuleCtx, flags map[rune]bool, args []string) error {
+	if len(args) < 2 {
+		return errors.New("missing destination operand")
+	}
+	dst := abs(mc, args[len(args)-1])
+	targets := args[:len(args)-1]
+	info, err := os.Stat(dst)
+	isdir := err == nil && info.IsDir()
+	if len(targets) > 1 && !isdir {
+		return fmt.Errorf("%s: not a directory", args[len(args)-1])
+	}
+	for _, t := range targets {
+		link := dst
+		if isdir {
+			link = filepath.Join(dst, filepath.Base(t))
+		}
+		if flags['f'] {
+			os.Remove(link)
+		}
+		if flags['s'] {
+			// the target of a symbolic link is stored as given
+			err = os.Symlink(t, link)
+		} else {
+			err = os.Link(abs(mc, t), link)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// subst OLD NEW [FILE...] replaces every occurrence of the string OLD with NEW
+// and writes the result to stdout. With -i, the files are modified in place.
+func subst(mc interp.ModuleCtx, flags map[rune]bool, args []string) error {
+	if len(args) < 2 {
+		return errors.New("usage: subst [-i] OLD NEW [FILE...]")
+	}
+	old, repl, files := []byte(args[0]), []byte(args[1]), args[2:]
+	if !flags['i'] {
+		return eachInput(mc, files, func(r io.Reader) error {
+			data, err := io.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			_, err = mc.Stdout.Write(bytes.ReplaceAll(data, old, repl))
+			return err
+		})
+	}
+	for _, f := range files {
+		p := abs(mc, f)
+		info, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		err = os.WriteFile(p, bytes.ReplaceAll(data, old, repl), info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -9,8 +9,13 @@ import (
 	"mvdan.cc/sh/syntax"
 )
 
+// Run executes 'cmd' with the internal shell. Common file operations (mkdir,
+// rm, cp, mv, touch, cat, ln, and subst) are provided as builtins.
 func Run(cmd string) error {
-	r, err := interp.New(interp.StdIO(os.Stdin, os.Stdout, os.Stderr))
+	r, err := interp.New(
+		interp.StdIO(os.Stdin, os.Stdout, os.Stderr),
+		interp.Module(interp.ModuleExec(Exec)),
+	)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,100 @@
+package shell
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBuiltins(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("PATH", "")
+
+	err := Run("cd " + dir + `
+mkdir -p a/b
+echo 'hello NAME' > a/b/f.txt
+cp -r a c
+mv c/b/f.txt c/g.txt
+subst NAME world c/g.txt > h.txt
+subst -i hello goodbye c/g.txt
+ln -s h.txt link.txt
+touch empty.txt
+cat link.txt empty.txt > all.txt
+rm -rf a c/b
+rm -f missing.txt
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := map[string]string{
+		"all.txt":   "hello world\n",
+		"c/g.txt":   "goodbye NAME\n",
+		"empty.txt": "",
+	}
+	for f, want := range expect {
+		data, err := os.ReadFile(filepath.Join(dir, f))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want {
+			t.Errorf("%s: expected %q, got %q", f, want, string(data))
+		}
+	}
+	for _, f := range []string{"a", "c/b"} {
+		if _, err := os.Stat(filepath.Join(dir, f)); err == nil {
+			t.Errorf("%s: expected to be removed", f)
+		}
+	}
+}
+
+func TestBuiltinError(t *testing.T) {
+	t.Setenv("PATH", "")
+	if err := Run("rm " + filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("expected error for missing file")
+	}
+}
+
+func TestProgramsOverBuiltins(t *testing.T) {
+	bin, dir := t.TempDir(), t.TempDir()
+	// a program named touch that writes to the file instead
+	script := "#!/bin/sh\necho program > \"$1\"\n"
+	if err := os.WriteFile(filepath.Join(bin, "touch"), []byte(script), 0777); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin)
+	if err := Run("cd " + dir + "\ntouch f.txt"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "f.txt"))
+	if err != nil || string(data) != "program\n" {
+		t.Errorf("expected the touch program to run, got %q (%v)", data, err)
+	}
+}
+
+func TestMove(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "a/b"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "a/b/f.txt"), []byte("f"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	// used when renaming fails because the paths are on different
+	// filesystems
+	if err := move(filepath.Join(dir, "a"), filepath.Join(dir, "c")); err != nil {
+		t.Fatal(err)
+	}
+	if err := move(filepath.Join(dir, "c/b/f.txt"), filepath.Join(dir, "g.txt")); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "g.txt"))
+	if err != nil || string(data) != "f" {
+		t.Errorf("unexpected contents of g.txt: %q (%v)", data, err)
+	}
+	for _, f := range []string{"a", "c/b/f.txt"} {
+		if _, err := os.Stat(filepath.Join(dir, f)); err == nil {
+			t.Errorf("%s: expected to be removed", f)
+		}
+	}
+}
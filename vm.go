@@ -2,7 +2,9 @@ package knit
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"io/fs"
 	"os"
@@ -10,8 +12,10 @@ import (
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/gobwas/glob"
 	"github.com/kballard/go-shellquote"
@@ -19,6 +23,7 @@ import (
 	lua "github.com/zyedidia/gopher-lua"
 	luar "github.com/zyedidia/gopher-luar"
 	"github.com/zyedidia/knit/expand"
+	"github.com/zyedidia/knit/rules"
 )
 
 // A LuaVM tracks the Lua state and keeps a stack of directories that have been
@@ -28,6 +33,20 @@ type LuaVM struct {
 	wd    *stack.Stack[string]
 	shell string // shell used to execute commands
 	flags Flags  // flags are accessible to Lua programs
+	// serializes calls into the VM from recipe functions, which may be run
+	// by several jobs at once
+	mu sync.Mutex
+	// lines of each file that has been executed, by name
+	sources map[string][]string
+	// if true, including a file that does not exist gives an empty
+	// buildset, and the file is added to 'missing'
+	allowMissing bool
+	missing      []string
+	// options declared with knit.option, in order and by name
+	options  []*Option
+	optindex map[string]*Option
+	// stores the results of configuration checks (may be nil)
+	db *rules.Database
 }
 
 // An LRule is an un-parsed Lua representation of a build rule.
@@ -35,6 +54,7 @@ type LRule struct {
 	Contents string
 	File     string
 	Line     int
+	Opts     rules.RuleOpts
 }
 
 func (r LRule) String() string {
@@ -103,10 +123,12 @@ func NewLuaVM(shell string, flags Flags) *LuaVM {
 	// TODO: make this only enabled in debug mode (the stack trace)
 	L := lua.NewState(lua.Options{SkipOpenLibs: true, IncludeGoStackTrace: true})
 	vm := &LuaVM{
-		L:     L,
-		wd:    stack.New[string](),
-		shell: shell,
-		flags: flags,
+		L:        L,
+		wd:       stack.New[string](),
+		shell:    shell,
+		flags:    flags,
+		sources:  make(map[string][]string),
+		optindex: make(map[string]*Option),
 	}
 	vm.wd.Push(".")
 
@@ -129,8 +151,11 @@ func NewLuaVM(shell string, flags Flags) *LuaVM {
 	L.SetField(rmt.LTable, "__tostring", luar.New(L, func(r LRule) string {
 		return r.String()
 	}))
-	L.SetGlobal("_rule", luar.New(L, mkrule))
-	L.SetGlobal("rule", luar.New(L, func(rule string) LRule {
+	L.SetGlobal("_rule", luar.New(L, func(rule string, file string, line int) LRule {
+		return mkrule(vm.realign(rule, file, line), file, line)
+	}))
+	L.SetGlobal("rule", L.NewFunction(func(L *lua.LState) int {
+		rule := L.CheckString(1)
 		dbg, ok := L.GetStack(1)
 		file := "<rule>"
 		line := 0
@@ -139,7 +164,22 @@ func NewLuaVM(shell string, flags Flags) *LuaVM {
 			file = dbg.Source
 			line = dbg.CurrentLine
 		}
-		return mkrule(rule, file, line)
+		r := mkrule(rule, file, line)
+		optidx := 2
+		var fn *lua.LFunction
+		if f, ok := L.Get(2).(*lua.LFunction); ok {
+			fn = f
+			optidx = 3
+		}
+		if opts, ok := L.Get(optidx).(*lua.LTable); ok {
+			r.Opts = vm.ruleOpts(opts)
+		}
+		if fn != nil {
+			r.Opts.Func = vm.recipeFunc(fn)
+			vm.checkFuncOpts(r.Opts)
+		}
+		L.Push(luar.New(L, r))
+		return 1
 	}))
 	L.SetGlobal("rulefile", luar.New(L, func(file string) LRule {
 		data, err := os.ReadFile(file)
@@ -206,6 +246,13 @@ func NewLuaVM(shell string, flags Flags) *LuaVM {
 			Dir: filepath.Join(vm.Wd(), dir),
 		}
 		b.Add(vals, vm)
+		if opts, ok := L.Get(3).(*lua.LTable); ok {
+			bopts := vm.ruleOpts(opts)
+			for i := range b.rset {
+				b.rset[i].Opts = mergeOpts(bopts, b.rset[i].Opts)
+				vm.checkFuncOpts(b.rset[i].Opts)
+			}
+		}
 		L.Push(luar.New(L, b))
 		return 1
 	}))
@@ -251,6 +298,12 @@ func NewLuaVM(shell string, flags Flags) *LuaVM {
 
 	// Include
 	L.SetGlobal("include", luar.New(L, func(path string) lua.LValue {
+		if _, err := os.Stat(path); vm.allowMissing && os.IsNotExist(err) {
+			// the file may be built by a generator rule, after which the
+			// Knitfile is evaluated again
+			vm.missing = append(vm.missing, path)
+			return luar.New(L, LBuildSet{Dir: filepath.Join(vm.Wd(), filepath.Dir(path))})
+		}
 		from := vm.EnterDir(filepath.Dir(path))
 		val, err := vm.DoFile(filepath.Base(path))
 		vm.LeaveDir(from)
@@ -341,6 +394,196 @@ func NewLuaVM(shell string, flags Flags) *LuaVM {
 	return vm
 }
 
+// Restores the blank lines that the Lua parser removes between consecutive
+// '$' rules, using the source of 'file', so that the lines of 'rule' match
+// the lines of the file starting at 'line'.
+func (vm *LuaVM) realign(rule string, file string, line int) string {
+	src, ok := vm.sources[file]
+	if !ok || line < 1 {
+		return rule
+	}
+	lines := strings.Split(rule, "\n")
+	aligned := make([]string, 0, len(lines))
+	s := line - 1
+	for i, l := range lines {
+		if i > 0 && strings.TrimSpace(l) != "" {
+			for s < len(src) && strings.TrimSpace(src[s]) == "" {
+				aligned = append(aligned, "")
+				s++
+			}
+		}
+		aligned = append(aligned, l)
+		s++
+	}
+	return strings.Join(aligned, "\n")
+}
+
+// Reads the per-rule options from a Lua table of the form {env={KEY=value},
+// dir="...", image="..."}. Environment variables may also be given as an array of
+// "KEY=value" strings.
+func (vm *LuaVM) ruleOpts(tbl *lua.LTable) rules.RuleOpts {
+	var opts rules.RuleOpts
+	switch env := tbl.RawGetString("env").(type) {
+	case *lua.LTable:
+		keys := make([]string, 0)
+		vals := make(map[string]string)
+		env.ForEach(func(k, v lua.LValue) {
+			if k.Type() == lua.LTNumber {
+				key, val, _ := strings.Cut(LToString(v), "=")
+				keys = append(keys, key)
+				vals[key] = val
+			} else {
+				keys = append(keys, LToString(k))
+				vals[LToString(k)] = LToString(v)
+			}
+		})
+		// sort so that the environment (and the recipe hash) is deterministic
+		sort.Strings(keys)
+		for _, k := range keys {
+			opts.Env = append(opts.Env, k+"="+vals[k])
+		}
+	case *lua.LNilType:
+	default:
+		vm.ErrStr(fmt.Sprintf("env must be a table, but got value %v", env.Type()))
+	}
+	switch dir := tbl.RawGetString("dir").(type) {
+	case lua.LString:
+		opts.Dir = string(dir)
+	case *lua.LNilType:
+	default:
+		vm.ErrStr(fmt.Sprintf("dir must be a string, but got value %v", dir.Type()))
+	}
+	switch image := tbl.RawGetString("image").(type) {
+	case lua.LString:
+		opts.Image = string(image)
+	case *lua.LNilType:
+	default:
+		vm.ErrStr(fmt.Sprintf("image must be a string, but got value %v", image.Type()))
+	}
+	return opts
+}
+
+// Wraps a Lua function so that it can be used as a recipe. The function is
+// called with a context table holding the rule's inputs, outputs, and matches,
+// and signals failure by raising an error.
+func (vm *LuaVM) recipeFunc(fn *lua.LFunction) *rules.RecipeFunc {
+	if fn.IsG {
+		vm.ErrStr("recipe must be a Lua function")
+	}
+	// the function's bytecode and the values that it captures are used to
+	// detect changes to the recipe
+	h := fnv.New64a()
+	writeLValue(h, fn, make(map[lua.LValue]bool))
+	return &rules.RecipeFunc{
+		Name: fmt.Sprintf("lua function at %s:%d", fn.Proto.SourceName, fn.Proto.LineDefined),
+		Key:  strconv.FormatUint(h.Sum64(), 16),
+		Call: func(ctx rules.RecipeContext) error {
+			vm.mu.Lock()
+			defer vm.mu.Unlock()
+
+			L := vm.L
+			strs := func(vals []string) *lua.LTable {
+				tbl := L.NewTable()
+				for _, v := range vals {
+					tbl.Append(lua.LString(v))
+				}
+				return tbl
+			}
+			tbl := L.NewTable()
+			tbl.RawSetString("dir", lua.LString(ctx.Dir))
+			tbl.RawSetString("input", lua.LString(strings.Join(ctx.Inputs, " ")))
+			tbl.RawSetString("inputs", strs(ctx.Inputs))
+			tbl.RawSetString("output", lua.LString(strings.Join(ctx.Outputs, " ")))
+			tbl.RawSetString("outputs", strs(ctx.Outputs))
+			tbl.RawSetString("match", lua.LString(ctx.Match))
+			tbl.RawSetString("matches", strs(ctx.Matches))
+			tbl.RawSetString("dep", lua.LString(ctx.Dep))
+			err := L.CallByParam(lua.P{
+				Fn:      fn,
+				NRet:    0,
+				Protect: true,
+			}, tbl)
+			if aerr, ok := err.(*lua.ApiError); ok {
+				// report only the message, without the stack trace
+				return errors.New(LToString(aerr.Object))
+			}
+			return err
+		},
+	}
+}
+
+// Writes a representation of 'v' that changes when its contents change.
+// Functions are written as their bytecode followed by their upvalues, and
+// tables as their sorted entries. Values in 'visiting' are being written
+// already, and are not written again so that cycles terminate.
+func writeLValue(w io.Writer, v lua.LValue, visiting map[lua.LValue]bool) {
+	switch v := v.(type) {
+	case lua.LString, lua.LNumber, lua.LBool, *lua.LNilType:
+		fmt.Fprintf(w, "%s:%q", v.Type(), v.String())
+	case *lua.LFunction:
+		if visiting[v] || v.IsG {
+			fmt.Fprintf(w, "%s:%t", v.Type(), v.IsG)
+			return
+		}
+		visiting[v] = true
+		defer delete(visiting, v)
+		fmt.Fprintf(w, "function:%q(", v.Proto.String())
+		for _, uv := range v.Upvalues {
+			writeLValue(w, uv.Value(), visiting)
+			io.WriteString(w, ",")
+		}
+		io.WriteString(w, ")")
+	case *lua.LTable:
+		if visiting[v] {
+			io.WriteString(w, "table:cycle")
+			return
+		}
+		visiting[v] = true
+		defer delete(visiting, v)
+		var entries []string
+		v.ForEach(func(key, val lua.LValue) {
+			buf := &bytes.Buffer{}
+			writeLValue(buf, key, visiting)
+			buf.WriteByte('=')
+			writeLValue(buf, val, visiting)
+			entries = append(entries, buf.String())
+		})
+		sort.Strings(entries)
+		fmt.Fprintf(w, "table:{%s}", strings.Join(entries, ","))
+	case *lua.LUserData:
+		fmt.Fprintf(w, "userdata:%T", v.Value)
+	default:
+		// other values (such as channels) only have an identity
+		io.WriteString(w, v.Type().String())
+	}
+}
+
+// Raises an error if 'opts' has a function recipe along with options that
+// only apply to commands, since the function runs within Knit.
+func (vm *LuaVM) checkFuncOpts(opts rules.RuleOpts) {
+	if opts.Func != nil && (len(opts.Env) > 0 || opts.Dir != "") {
+		vm.ErrStr(fmt.Sprintf("the env and dir options cannot be used with the %s", opts.Func.Name))
+	}
+}
+
+// Combines the options of a buildset with the options of one of its rules.
+// The rule's options take precedence.
+func mergeOpts(outer, inner rules.RuleOpts) rules.RuleOpts {
+	opts := rules.RuleOpts{
+		Env:   append(append([]string{}, outer.Env...), inner.Env...),
+		Dir:   outer.Dir,
+		Func:  inner.Func,
+		Image: outer.Image,
+	}
+	if inner.Dir != "" {
+		opts.Dir = inner.Dir
+	}
+	if inner.Image != "" {
+		opts.Image = inner.Image
+	}
+	return opts
+}
+
 // EnterDir changes into 'dir' and returns the path of the directory that was
 // changed out of.
 func (vm *LuaVM) EnterDir(dir string) string {
@@ -410,7 +653,17 @@ func (vm *LuaVM) DoFile(file string) (lua.LValue, error) {
 	if vm.Wd() != "." {
 		file = filepath.Join(vm.Wd(), file)
 	}
-	if fn, err := vm.L.Load(f, file); err != nil {
+	return vm.DoReader(f, file)
+}
+
+// DoReader executes the Lua code read from 'r', using 'file' as its name.
+func (vm *LuaVM) DoReader(r io.Reader, file string) (lua.LValue, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	vm.sources[file] = strings.Split(string(data), "\n")
+	if fn, err := vm.L.Load(bytes.NewReader(data), file); err != nil {
 		return nil, err
 	} else {
 		vm.L.Push(fn)
@@ -422,6 +675,16 @@ func (vm *LuaVM) DoFile(file string) (lua.LValue, error) {
 	}
 }
 
+// Lock gives exclusive access to the Lua state, which is shared by recipe
+// functions and by recipes that are expanded during the build.
+func (vm *LuaVM) Lock() {
+	vm.mu.Lock()
+}
+
+func (vm *LuaVM) Unlock() {
+	vm.mu.Unlock()
+}
+
 // ExpandFuncs returns a set of functions used for expansion. The first expands
 // by looking up variables in the current Lua context, and the second evaluates
 // arbitrary Lua expressions.
@@ -487,6 +750,9 @@ func (vm *LuaVM) pkgknit() *lua.LTable {
 	vm.L.SetField(pkg, "os", luar.New(vm.L, runtime.GOOS))
 	vm.L.SetField(pkg, "arch", luar.New(vm.L, runtime.GOARCH))
 	vm.L.SetField(pkg, "flags", luar.New(vm.L, vm.flags))
+	vm.L.SetField(pkg, "builddir", luar.New(vm.L, BuildDir(vm.flags)))
+	vm.L.SetField(pkg, "option", vm.L.NewFunction(vm.declareOption))
+	vm.addProbes(pkg)
 	vm.L.SetField(pkg, "join", luar.New(vm.L, func(strs ...[]string) *lua.LTable {
 		if len(strs) == 0 {
 			return nil
@@ -586,6 +852,9 @@ func (vm *LuaVM) pkgknit() *lua.LTable {
 		return GoStrSliceToTable(vm.L, removed)
 	}))
 	vm.L.SetField(pkg, "shell", luar.New(vm.L, func(shcmd string) string {
+		if vm.flags.NoCommands {
+			return ""
+		}
 		cmd := exec.Command(vm.shell, "-c", shcmd)
 		b, err := cmd.Output()
 		if err != nil {
@@ -609,6 +878,9 @@ func (vm *LuaVM) pkgknit() *lua.LTable {
 		}
 	}))
 	vm.L.SetField(pkg, "knit", luar.New(vm.L, func(flags string) string {
+		if vm.flags.NoCommands {
+			return ""
+		}
 		path, err := os.Executable()
 		if err != nil {
 			vm.Err(err)